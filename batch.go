@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	h "github.com/a4lex/go-helpers"
+)
+
+//
+// Batch inserts - multi-row INSERT is built with placeholders, so values fetched from devices
+// (ifDescr, radio-name etc.) are never spliced into SQL, rows are split to several queries
+// to fit max_allowed_packet of DB and limit of placeholders of prepared statement
+//
+
+const batchMaxPlaceholders = 65535
+
+var dbMaxPacket = flag.Int("db-max-packet", 1048576, "Max size of one batch insert query, bytes (max_allowed_packet of DB)")
+
+//
+// BatchInsert struct for build multi-row INSERT queries
+//
+type BatchInsert struct {
+	head    string // INSERT INTO ... VALUES
+	row     string // placeholders of one row, e.g. (?, ?, NOW())
+	tail    string // ON DUPLICATE KEY UPDATE ..., can be empty
+	cols    int
+	rows    int
+	size    int
+	args    []interface{}
+	queries []h.Query
+}
+
+//
+// NewBatchInsert - return builder of queries head + row, row, ... + tail
+//
+func NewBatchInsert(head, row, tail string) *BatchInsert {
+	return &BatchInsert{head: head, row: row, tail: tail, cols: strings.Count(row, "?")}
+}
+
+//
+// Add - add row of values, count of values should match placeholders of row
+//
+func (b *BatchInsert) Add(args ...interface{}) {
+	if len(args) != b.cols {
+		l.Printf(h.ERROR, "Batch insert: got %d values for %d placeholders, row is skipped: %s", len(args), b.cols, b.head)
+		return
+	}
+
+	size := len(b.row) + 2
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			size += 2*len(v) + 2 // value can be escaped by driver
+		case []byte:
+			size += 2*len(v) + 2
+		default:
+			size += 24
+		}
+	}
+
+	if b.rows > 0 && (b.size+size > *dbMaxPacket || len(b.args)+b.cols > batchMaxPlaceholders) {
+		b.finish()
+	}
+	if b.rows == 0 {
+		b.size = len(b.head) + len(b.tail)
+	}
+
+	b.args = append(b.args, args...)
+	b.rows++
+	b.size += size
+}
+
+//
+// Len - return count of rows which are not sent yet
+//
+func (b *BatchInsert) Len() int {
+	rows := b.rows
+	for _, q := range b.queries {
+		rows += len(q.Args) / b.cols
+	}
+	return rows
+}
+
+//
+// Queries - return built queries and reset builder
+//
+func (b *BatchInsert) Queries() []h.Query {
+	b.finish()
+	queries := b.queries
+	b.queries = nil
+	return queries
+}
+
+//
+// Send - send built queries to query queue and reset builder
+//
+func (b *BatchInsert) Send(queue chan h.Query) {
+	for _, query := range b.Queries() {
+		queue <- query
+	}
+}
+
+//
+// finish - build query of added rows
+//
+func (b *BatchInsert) finish() {
+	if b.rows == 0 {
+		return
+	}
+
+	query := b.head + strings.TrimRight(strings.Repeat(b.row+", ", b.rows), ", ")
+	if b.tail != "" {
+		query += " " + b.tail
+	}
+	b.queries = append(b.queries, h.Query{Query: query, Args: b.args})
+	b.args, b.rows, b.size = nil, 0, 0
+}
+
+//
+// SQLIn - return placeholders for IN (...) of n values
+//
+func SQLIn(n int) string {
+	return strings.TrimRight(strings.Repeat("?, ", n), ", ")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	h "github.com/a4lex/go-helpers"
+)
+
+//
+// Prometheus exporter - serve last fetched values on /metrics
+//
+
+var (
+	metricsListen = flag.String("metrics-listen", "", "Address for serve /metrics, run as daemon if set (e.g. :9116)")
+
+	exporterOnce sync.Once
+	reMetricName = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+)
+
+type promSample struct {
+	series *Series
+	value  float64
+	time   time.Time
+}
+
+//
+// PrometheusSink store last value of every series for serve it on /metrics
+//
+type PrometheusSink struct {
+	mu      sync.Mutex
+	samples map[string]*promSample
+}
+
+//
+// NewPrometheusSink - return new empty prometheus sink
+//
+func NewPrometheusSink() *PrometheusSink {
+	return &PrometheusSink{samples: make(map[string]*promSample)}
+}
+
+//
+// StartExporter - serve /metrics, robot works as daemon after start
+//
+func StartExporter() {
+	exporterOnce.Do(func() {
+		exporter := NewPrometheusSink()
+		sinks = append(sinks, exporter)
+		*daemon = true
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", exporter)
+		go func() {
+			l.Printf(h.INFO, "Serve metrics on %s/metrics", *metricsListen)
+			if err := http.ListenAndServe(*metricsListen, mux); err != nil {
+				l.Printf(h.FATAL, "Can not serve metrics on %s: %s", *metricsListen, err)
+			}
+		}()
+	})
+}
+
+//
+// Store - remember last value of series
+//
+func (p *PrometheusSink) Store(s *Series, t time.Time, val *big.Float) error {
+	key := s.Path + "\x00" + s.ObjectID
+
+	// unknown value is not served
+	if val == nil {
+		p.mu.Lock()
+		delete(p.samples, key)
+		p.mu.Unlock()
+		return nil
+	}
+	value, _ := val.Float64()
+
+	p.mu.Lock()
+	p.samples[key] = &promSample{series: s, value: value, time: t}
+	p.mu.Unlock()
+
+	return nil
+}
+
+//
+// Flush - nothing to flush, values are served from memory
+//
+func (p *PrometheusSink) Flush() error {
+	return nil
+}
+
+//
+// Close - nothing to close
+//
+func (p *PrometheusSink) Close() error {
+	return nil
+}
+
+//
+// ServeHTTP - write all actual values in prometheus text format
+//
+func (p *PrometheusSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	byName := make(map[string][]*promSample)
+	names := make([]string, 0)
+
+	p.mu.Lock()
+	for key, sample := range p.samples {
+		// values of removed devices/ifaces should not be served forever
+		ttl := 3 * CycleStep()
+		if step := 3 * time.Duration(sample.series.Step) * time.Second; step > ttl {
+			ttl = step
+		}
+		if time.Since(sample.time) > ttl {
+			delete(p.samples, key)
+			continue
+		}
+
+		name := "snmp_" + strings.Trim(reMetricName.ReplaceAllString(sample.series.Path, "_"), "_")
+		if _, ok := byName[name]; !ok {
+			names = append(names, name)
+		}
+		byName[name] = append(byName[name], sample)
+	}
+	p.mu.Unlock()
+
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	for _, name := range names {
+		samples := byName[name]
+		sort.Slice(samples, func(i, j int) bool { return samples[i].series.ObjectID < samples[j].series.ObjectID })
+
+		metricType := "gauge"
+		if samples[0].series.CounterType == "COUNTER" {
+			metricType = "counter"
+		}
+		fmt.Fprintf(w, "# HELP %s SNMP template %s\n# TYPE %s %s\n", name, samples[0].series.Path, name, metricType)
+
+		for _, sample := range samples {
+			fmt.Fprintf(w, "%s{device_id=\"%s\",iface_id=\"%s\",device_type_id=\"%s\",path=\"%s\"} %s\n", name,
+				promEscape(sample.series.DeviceID), promEscape(sample.series.IfaceID),
+				promEscape(sample.series.DeviceType), promEscape(sample.series.Path),
+				strconv.FormatFloat(sample.value, 'g', -1, 64))
+		}
+	}
+}
+
+func promEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	h "github.com/a4lex/go-helpers"
+)
+
+//
+// MIB loader - parses SMIv1/SMIv2 MIB files of -mib-dirs, so templates can use symbolic names
+// like IF-MIB::ifHCInOctets (or ifHCInOctets if name is unique) with optional index suffix,
+// names are resolved to numeric OIDs when templates are created
+//
+
+//
+// MibNode struct for store object of MIB
+//
+type MibNode struct {
+	Module string
+	Name   string
+	OID    string // numeric with leading dot, empty if parent is not found
+	Syntax string // SYNTAX of OBJECT-TYPE as written in MIB, e.g. DisplayString
+	Base   string // base type of syntax, e.g. OCTET STRING for DisplayString
+	Units  string // UNITS of OBJECT-TYPE
+
+	parent string
+	subs   []string
+}
+
+var (
+	mibDirs = flag.String("mib-dirs", "", "Dirs with MIB files separated by ':' for symbolic OIDs in templates")
+
+	mibOnce    sync.Once
+	mibModules = make(map[string]map[string]*MibNode) // module -> name -> node
+	mibImports = make(map[string]map[string]string)   // module -> name -> module of import
+	mibNames   = make(map[string]*MibNode)            // name -> node of first loaded module
+	mibByOID   = make(map[string]*MibNode)
+	mibTypes   = make(map[string]map[string]string) // module -> textual convention -> syntax
+	mibTypeOf  = make(map[string]string)            // textual convention -> module of first definition
+
+	// roots of OID tree, SNMPv2-SMI is not required for resolve names
+	mibRoots = map[string]string{
+		"ccitt": ".0", "iso": ".1", "joint-iso-ccitt": ".2", "org": ".1.3", "dod": ".1.3.6",
+		"internet": ".1.3.6.1", "directory": ".1.3.6.1.1", "mgmt": ".1.3.6.1.2", "mib-2": ".1.3.6.1.2.1",
+		"transmission": ".1.3.6.1.2.1.10", "experimental": ".1.3.6.1.3", "private": ".1.3.6.1.4",
+		"enterprises": ".1.3.6.1.4.1", "security": ".1.3.6.1.5", "snmpV2": ".1.3.6.1.6",
+		"snmpDomains": ".1.3.6.1.6.1", "snmpProxys": ".1.3.6.1.6.2", "snmpModules": ".1.3.6.1.6.3",
+	}
+
+	// base types of SMI, textual conventions are resolved to them
+	mibBaseTypes = map[string]bool{
+		"INTEGER": true, "Integer32": true, "Unsigned32": true, "Counter32": true, "Counter64": true,
+		"Gauge32": true, "TimeTicks": true, "IpAddress": true, "Opaque": true, "OCTET STRING": true,
+		"OBJECT IDENTIFIER": true, "BITS": true, "Counter": true, "Gauge": true, "NetworkAddress": true,
+	}
+
+	// macros which define OID of node by ::= { parent sub }
+	mibMacros = map[string]bool{
+		"OBJECT-TYPE": true, "MODULE-IDENTITY": true, "OBJECT-IDENTITY": true, "NOTIFICATION-TYPE": true,
+		"OBJECT-GROUP": true, "NOTIFICATION-GROUP": true, "MODULE-COMPLIANCE": true, "AGENT-CAPABILITIES": true,
+		"TRAP-TYPE": true,
+	}
+)
+
+//
+// LoadMibs - load MIB files of all dirs once, files with errors are skipped
+//
+func LoadMibs() {
+	mibOnce.Do(func() {
+		if *mibDirs == "" {
+			return
+		}
+
+		for _, dir := range strings.Split(*mibDirs, ":") {
+			files, err := ioutil.ReadDir(dir)
+			if err != nil {
+				l.Printf(h.ERROR, "Can not read MIB dir: %s", err)
+				continue
+			}
+			for _, f := range files {
+				if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+					continue
+				}
+				if err := loadMibFile(filepath.Join(dir, f.Name())); err != nil {
+					l.Printf(h.ERROR, "Can not load MIB file %s: %s", f.Name(), err)
+				}
+			}
+		}
+
+		count := 0
+		for _, nodes := range mibModules {
+			for _, node := range nodes {
+				if resolveMibNode(node, 0) != "" {
+					mibByOID[node.OID] = node
+					count++
+				}
+			}
+		}
+		l.Printf(h.INFO, "Loaded MIB modules: %d, objects: %d", len(mibModules), count)
+	})
+}
+
+//
+// ResolveOID - return numeric OID of query and its MIB object (nil if MIB is not loaded),
+// query is numeric OID or [MODULE::]name[.index]
+//
+func ResolveOID(query string) (string, *MibNode, error) {
+	LoadMibs()
+
+	query = strings.TrimSpace(query)
+	if query == "" || query[0] == '.' || (query[0] >= '0' && query[0] <= '9') {
+		// index of numeric OID is not known, so only object with syntax is taken
+		if node := LookupMibOID(query); node != nil && node.Syntax != "" {
+			return query, node, nil
+		}
+		return query, nil, nil
+	}
+
+	name, suffix := query, ""
+	if i := strings.Index(query, "."); i >= 0 {
+		name, suffix = query[:i], query[i:]
+	}
+
+	var node *MibNode
+	if i := strings.Index(name, "::"); i >= 0 {
+		node = mibModules[name[:i]][name[i+2:]]
+	} else {
+		node = mibNames[name]
+	}
+	if node == nil || node.OID == "" {
+		return "", nil, fmt.Errorf("unknown MIB object: %s", name)
+	}
+	return node.OID + suffix, node, nil
+}
+
+//
+// LookupMibOID - return MIB object of numeric OID or its nearest parent, nil if none
+//
+func LookupMibOID(oid string) *MibNode {
+	oid = "." + strings.Trim(oid, ".")
+	for oid != "" {
+		if node, ok := mibByOID[oid]; ok {
+			return node
+		}
+		oid = oid[:strings.LastIndex(oid, ".")]
+	}
+	return nil
+}
+
+//
+// CheckTemplate - return warning if counter type or value parsing of template does not match
+// type of MIB object, empty if template is fine
+//
+func (node *MibNode) CheckTemplate(counterType string, extract bool) string {
+	counter := node.Base == "Counter32" || node.Base == "Counter64" || node.Base == "Counter"
+	switch {
+	case node.Base == "" || node.Base == "SEQUENCE":
+		return fmt.Sprintf("%s::%s is not scalar or column object", node.Module, node.Name)
+	case counter && counterType != "COUNTER" && counterType != "DERIVE":
+		return fmt.Sprintf("%s::%s is %s, but template type is %s", node.Module, node.Name, node.Syntax, counterType)
+	case !counter && counterType == "COUNTER":
+		return fmt.Sprintf("%s::%s is %s, it is not counter", node.Module, node.Name, node.Syntax)
+	case node.Base == "OCTET STRING" && !extract && node.Units != "":
+		return fmt.Sprintf("%s::%s is string with units '%s', template has no extract", node.Module, node.Name, node.Units)
+	case node.Base == "IpAddress" || node.Base == "OBJECT IDENTIFIER" || node.Base == "BITS":
+		return fmt.Sprintf("%s::%s is %s, it is not number", node.Module, node.Name, node.Syntax)
+	}
+	return ""
+}
+
+//
+// resolveMibNode - set numeric OID and base type of node by its parents, depth guards from loops
+//
+func resolveMibNode(node *MibNode, depth int) string {
+	if node.OID != "" || depth > 128 {
+		return node.OID
+	}
+
+	oid, ok := mibRoots[node.parent]
+	if parent := findMibNode(node.Module, node.parent); parent != nil {
+		oid, ok = resolveMibNode(parent, depth+1), true
+	}
+	if !ok || oid == "" {
+		return ""
+	}
+	for _, sub := range node.subs {
+		oid += "." + sub
+	}
+	node.OID = oid
+	node.Base = mibBaseType(node.Module, node.Syntax)
+	return oid
+}
+
+//
+// findMibNode - find node by name in module, its imports or in any module
+//
+func findMibNode(module, name string) *MibNode {
+	if node, ok := mibModules[module][name]; ok {
+		return node
+	}
+	if from, ok := mibImports[module][name]; ok {
+		if node, ok := mibModules[from][name]; ok {
+			return node
+		}
+	}
+	return mibNames[name]
+}
+
+//
+// findMibType - find syntax of textual convention in module, its imports or in any module,
+// return syntax and module where it is defined
+//
+func findMibType(module, name string) (string, string, bool) {
+	if syntax, ok := mibTypes[module][name]; ok {
+		return syntax, module, true
+	}
+	if from, ok := mibImports[module][name]; ok {
+		if syntax, ok := mibTypes[from][name]; ok {
+			return syntax, from, true
+		}
+	}
+	if from, ok := mibTypeOf[name]; ok {
+		return mibTypes[from][name], from, true
+	}
+	return "", "", false
+}
+
+//
+// mibBaseType - resolve textual conventions of syntax used in module to base type,
+// textual convention is looked up in module where previous one is defined
+//
+func mibBaseType(module, syntax string) string {
+	for i := 0; i < 16; i++ {
+		if syntax == "" || mibBaseTypes[syntax] || strings.HasPrefix(syntax, "SEQUENCE") {
+			break
+		}
+		base, from, ok := findMibType(module, syntax)
+		if !ok {
+			return ""
+		}
+		syntax, module = base, from
+	}
+	if strings.HasPrefix(syntax, "SEQUENCE") {
+		return "SEQUENCE"
+	}
+	return syntax
+}
+
+//
+// loadMibFile - parse all modules of MIB file
+//
+func loadMibFile(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	p := &mibParser{tokens: tokenizeMib(string(data))}
+
+	for p.pos < len(p.tokens) {
+		if p.peek(1) != "DEFINITIONS" {
+			p.pos++
+			continue
+		}
+		module := p.next()
+		for p.pos < len(p.tokens) && p.next() != "BEGIN" {
+		}
+		if err := p.parseModule(module); err != nil {
+			return fmt.Errorf("module %s: %s", module, err)
+		}
+	}
+	return nil
+}
+
+type mibParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *mibParser) peek(n int) string {
+	if p.pos+n < len(p.tokens) {
+		return p.tokens[p.pos+n]
+	}
+	return ""
+}
+
+func (p *mibParser) next() string {
+	tok := p.peek(0)
+	p.pos++
+	return tok
+}
+
+//
+// parseModule - parse imports, textual conventions and nodes of module till END
+//
+func (p *mibParser) parseModule(module string) error {
+	if _, ok := mibModules[module]; ok {
+		// module from other file (e.g. copy with other extension) is loaded already
+		return nil
+	}
+	nodes := make(map[string]*MibNode)
+	imports := make(map[string]string)
+	types := make(map[string]string)
+
+	for p.pos < len(p.tokens) {
+		tok := p.next()
+		switch {
+		case tok == "END":
+			mibModules[module], mibImports[module], mibTypes[module] = nodes, imports, types
+			for name, node := range nodes {
+				if _, ok := mibNames[name]; !ok {
+					mibNames[name] = node
+				}
+			}
+			for name := range types {
+				if _, ok := mibTypeOf[name]; !ok {
+					mibTypeOf[name] = module
+				}
+			}
+			return nil
+
+		case tok == "IMPORTS":
+			names := make([]string, 0)
+			for p.pos < len(p.tokens) && p.peek(0) != ";" {
+				if t := p.next(); t == "FROM" {
+					from := p.next()
+					for _, name := range names {
+						imports[name] = from
+					}
+					names = names[:0]
+				} else if t != "," {
+					names = append(names, t)
+				}
+			}
+			p.pos++
+
+		case p.peek(0) == "MACRO":
+			// definition of macro (in SMI modules), it has own syntax
+			for p.pos < len(p.tokens) && p.next() != "END" {
+			}
+
+		case p.peek(0) == "OBJECT" && p.peek(1) == "IDENTIFIER" && p.peek(2) == "::=":
+			p.pos += 3
+			node := &MibNode{Module: module, Name: tok}
+			if err := p.parseValue(node); err != nil {
+				return err
+			}
+			nodes[tok] = node
+
+		case mibMacros[p.peek(0)]:
+			node := &MibNode{Module: module, Name: tok}
+			if err := p.parseMacro(node); err != nil {
+				return err
+			}
+			nodes[tok] = node
+
+		case p.peek(0) == "::=" && isMibTypeName(tok):
+			p.pos++
+			types[tok] = p.parseTypeAssignment()
+		}
+	}
+	return fmt.Errorf("unexpected end of file")
+}
+
+//
+// parseMacro - parse clauses of OBJECT-TYPE like macro and its OID value
+//
+func (p *mibParser) parseMacro(node *MibNode) error {
+	macro := p.next()
+	enterprise := ""
+	for p.pos < len(p.tokens) {
+		switch p.next() {
+		case "SYNTAX":
+			node.Syntax = p.parseSyntax()
+		case "UNITS":
+			node.Units = strings.Trim(p.next(), `"`)
+		case "ENTERPRISE":
+			enterprise = p.next()
+		case "::=":
+			// SMIv1 trap is enterprise.0.specific
+			if macro == "TRAP-TYPE" {
+				node.parent, node.subs = enterprise, []string{"0", p.next()}
+				return nil
+			}
+			return p.parseValue(node)
+		}
+	}
+	return fmt.Errorf("unexpected end of %s %s", macro, node.Name)
+}
+
+//
+// parseSyntax - return type of SYNTAX clause without constraints and named numbers
+//
+func (p *mibParser) parseSyntax() string {
+	syntax := p.next()
+	switch {
+	case (syntax == "OCTET" && p.peek(0) == "STRING") || (syntax == "OBJECT" && p.peek(0) == "IDENTIFIER"):
+		syntax += " " + p.next()
+	case syntax == "SEQUENCE" && p.peek(0) == "OF":
+		p.pos++
+		syntax = "SEQUENCE OF " + p.next()
+	}
+	p.skipBraces()
+	return syntax
+}
+
+//
+// parseTypeAssignment - return syntax of textual convention or type assignment
+//
+func (p *mibParser) parseTypeAssignment() string {
+	if p.peek(0) == "TEXTUAL-CONVENTION" {
+		for p.pos < len(p.tokens) && p.peek(0) != "SYNTAX" {
+			p.pos++
+		}
+		p.pos++
+		return p.parseSyntax()
+	}
+
+	// e.g. [APPLICATION 4] IMPLICIT OCTET STRING (SIZE (0..65535))
+	if p.peek(0) == "[" {
+		for p.pos < len(p.tokens) && p.next() != "]" {
+		}
+	}
+	if p.peek(0) == "IMPLICIT" {
+		p.pos++
+	}
+	if p.peek(0) == "CHOICE" {
+		p.pos++
+		p.skipBraces()
+		return ""
+	}
+	return p.parseSyntax()
+}
+
+//
+// parseValue - parse OID value { parent [name(]sub[)] ... }
+//
+func (p *mibParser) parseValue(node *MibNode) error {
+	if p.next() != "{" {
+		return fmt.Errorf("bad OID value of %s", node.Name)
+	}
+	for first := true; p.pos < len(p.tokens); first = false {
+		tok := p.next()
+		switch {
+		case tok == "}":
+			if node.parent == "" {
+				return fmt.Errorf("empty OID value of %s", node.Name)
+			}
+			return nil
+		case first && !isMibNumber(tok):
+			node.parent = tok
+		case first:
+			node.parent, node.subs = "iso", nil
+			if tok != "1" {
+				return fmt.Errorf("unsupported OID root of %s", node.Name)
+			}
+		case p.peek(0) == "(":
+			// named number, e.g. org(3)
+			node.subs = append(node.subs, p.peek(1))
+			p.pos += 3
+		case isMibNumber(tok):
+			node.subs = append(node.subs, tok)
+		default:
+			return fmt.Errorf("bad OID value of %s: %s", node.Name, tok)
+		}
+	}
+	return fmt.Errorf("unexpected end of OID value of %s", node.Name)
+}
+
+//
+// skipBraces - skip constraints (...) and named numbers {...} of syntax
+//
+func (p *mibParser) skipBraces() {
+	for p.peek(0) == "(" || p.peek(0) == "{" {
+		depth := 0
+		for p.pos < len(p.tokens) {
+			tok := p.next()
+			if tok == "(" || tok == "{" {
+				depth++
+			} else if tok == ")" || tok == "}" {
+				if depth--; depth == 0 {
+					break
+				}
+			}
+		}
+	}
+}
+
+//
+// tokenizeMib - split MIB text to tokens, comments are skipped, strings are kept with quotes
+//
+func tokenizeMib(s string) []string {
+	tokens := make([]string, 0, len(s)/8)
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case strings.HasPrefix(s[i:], "--"):
+			// comment till end of line or next --
+			j := i + 2
+			for j < len(s) && s[j] != '\n' && !strings.HasPrefix(s[j:], "--") {
+				j++
+			}
+			if strings.HasPrefix(s[j:], "--") {
+				j += 2
+			}
+			i = j
+		case c == '"':
+			j := strings.IndexByte(s[i+1:], '"')
+			if j < 0 {
+				j = len(s) - i - 2
+			}
+			tokens = append(tokens, s[i:i+j+2])
+			i += j + 2
+		case strings.HasPrefix(s[i:], "::="):
+			tokens = append(tokens, "::=")
+			i += 3
+		case strings.HasPrefix(s[i:], ".."):
+			tokens = append(tokens, "..")
+			i += 2
+		case isMibIdentChar(c) || c == '\'':
+			j := i + 1
+			for j < len(s) && (isMibIdentChar(s[j]) || (s[j] == '-' && !strings.HasPrefix(s[j:], "--")) || s[j] == '\'') {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	return tokens
+}
+
+func isMibIdentChar(c byte) bool {
+	return c == '_' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isMibNumber(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 64)
+	return err == nil
+}
+
+func isMibTypeName(s string) bool {
+	return s != "" && s[0] >= 'A' && s[0] <= 'Z'
+}
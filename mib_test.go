@@ -0,0 +1,203 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+const (
+	mibTestSMI = `
+SNMPv2-TC DEFINITIONS ::= BEGIN
+
+DisplayString ::= TEXTUAL-CONVENTION
+    DISPLAY-HINT "255a"
+    STATUS       current
+    DESCRIPTION  "Text"
+    SYNTAX       OCTET STRING (SIZE (0..255))
+
+END
+`
+	mibTestIF = `
+IF-MIB DEFINITIONS ::= BEGIN
+
+IMPORTS
+    MODULE-IDENTITY, OBJECT-TYPE, Counter64, Integer32, mib-2
+        FROM SNMPv2-SMI
+    DisplayString
+        FROM SNMPv2-TC;
+
+ifMIB MODULE-IDENTITY
+    LAST-UPDATED "200006140000Z"
+    ORGANIZATION "IETF"
+    CONTACT-INFO "-"
+    DESCRIPTION  "Interfaces"
+    ::= { mib-2 31 }
+
+InterfaceIndex ::= TEXTUAL-CONVENTION
+    DISPLAY-HINT "d"
+    STATUS       current
+    DESCRIPTION  "Index of iface"
+    SYNTAX       Integer32 (1..2147483647)
+
+interfaces   OBJECT IDENTIFIER ::= { mib-2 2 }
+ifMIBObjects OBJECT IDENTIFIER ::= { ifMIB 1 }
+
+ifTable OBJECT-TYPE
+    SYNTAX      SEQUENCE OF IfEntry
+    MAX-ACCESS  not-accessible
+    STATUS      current
+    DESCRIPTION "-- not a comment --"
+    ::= { interfaces 2 }
+
+ifEntry OBJECT-TYPE
+    SYNTAX      IfEntry
+    MAX-ACCESS  not-accessible
+    STATUS      current
+    DESCRIPTION "Entry"
+    INDEX       { ifIndex }
+    ::= { ifTable 1 }
+
+IfEntry ::= SEQUENCE { ifIndex InterfaceIndex, ifDescr DisplayString }
+
+ifIndex OBJECT-TYPE
+    SYNTAX      InterfaceIndex
+    MAX-ACCESS  read-only
+    STATUS      current
+    DESCRIPTION "Index"
+    ::= { ifEntry 1 }
+
+ifDescr OBJECT-TYPE
+    SYNTAX      DisplayString (SIZE (0..255))
+    MAX-ACCESS  read-only
+    STATUS      current
+    DESCRIPTION "Descr"
+    ::= { ifEntry 2 }
+
+ifXTable OBJECT-TYPE
+    SYNTAX      SEQUENCE OF IfXEntry
+    MAX-ACCESS  not-accessible
+    STATUS      current
+    DESCRIPTION "Ext"
+    ::= { ifMIBObjects 1 }
+
+ifXEntry OBJECT-TYPE
+    SYNTAX      IfXEntry
+    MAX-ACCESS  not-accessible
+    STATUS      current
+    DESCRIPTION "Entry"
+    INDEX       { ifIndex }
+    ::= { ifXTable 1 }
+
+ifHCInOctets OBJECT-TYPE
+    SYNTAX      Counter64
+    UNITS       "octets"
+    MAX-ACCESS  read-only
+    STATUS      current
+    DESCRIPTION "In"
+    ::= { ifXEntry 6 }
+
+END
+`
+	// vendor module has own InterfaceIndex, objects of IF-MIB keep type of IF-MIB
+	mibTestVendor = `
+VENDOR-MIB DEFINITIONS ::= BEGIN
+
+IMPORTS
+    OBJECT-TYPE, Integer32, enterprises FROM SNMPv2-SMI
+    DisplayString FROM SNMPv2-TC;
+
+InterfaceIndex ::= OCTET STRING (SIZE (1..32))
+PowerLevel ::= TEXTUAL-CONVENTION
+    STATUS      current
+    DESCRIPTION "Optical power"
+    SYNTAX      Integer32
+
+vendor      OBJECT IDENTIFIER ::= { enterprises 3320 }
+onuTable    OBJECT IDENTIFIER ::= { vendor 101 }
+
+onuIface OBJECT-TYPE
+    SYNTAX      InterfaceIndex
+    MAX-ACCESS  read-only
+    STATUS      current
+    DESCRIPTION "Name of PON port"
+    ::= { onuTable 1 }
+
+onuRxPower OBJECT-TYPE
+    SYNTAX      PowerLevel
+    UNITS       "0.1 dBm"
+    MAX-ACCESS  read-only
+    STATUS      current
+    DESCRIPTION "Rx"
+    ::= { onuTable 2 }
+
+onuName OBJECT-TYPE
+    SYNTAX      DisplayString
+    MAX-ACCESS  read-only
+    STATUS      current
+    DESCRIPTION "Name"
+    ::= { onuTable 3 }
+
+END
+`
+)
+
+//
+// mibTestLoad - load MIB files with given content instead of -mib-dirs
+//
+func mibTestLoad(t *testing.T, files map[string]string) {
+	dir := t.TempDir()
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	*mibDirs = dir
+	mibOnce = sync.Once{}
+	mibModules = make(map[string]map[string]*MibNode)
+	mibImports = make(map[string]map[string]string)
+	mibNames = make(map[string]*MibNode)
+	mibByOID = make(map[string]*MibNode)
+	mibTypes = make(map[string]map[string]string)
+	mibTypeOf = make(map[string]string)
+	LoadMibs()
+}
+
+func TestResolveOID(t *testing.T) {
+	// vendor file is loaded first, its InterfaceIndex is found first by name
+	mibTestLoad(t, map[string]string{"0-VENDOR-MIB": mibTestVendor, "IF-MIB.txt": mibTestIF, "SNMPv2-TC": mibTestSMI})
+
+	for _, c := range []struct {
+		query, oid, syntax, base, units string
+	}{
+		{"IF-MIB::ifHCInOctets", ".1.3.6.1.2.1.31.1.1.1.6", "Counter64", "Counter64", "octets"},
+		{"ifHCInOctets.5", ".1.3.6.1.2.1.31.1.1.1.6.5", "Counter64", "Counter64", "octets"},
+		{"IF-MIB::ifIndex", ".1.3.6.1.2.1.2.2.1.1", "InterfaceIndex", "Integer32", ""},
+		{"ifDescr", ".1.3.6.1.2.1.2.2.1.2", "DisplayString", "OCTET STRING", ""},
+		{"VENDOR-MIB::onuIface", ".1.3.6.1.4.1.3320.101.1", "InterfaceIndex", "OCTET STRING", ""},
+		{"onuRxPower.1", ".1.3.6.1.4.1.3320.101.2.1", "PowerLevel", "Integer32", "0.1 dBm"},
+		{"onuName", ".1.3.6.1.4.1.3320.101.3", "DisplayString", "OCTET STRING", ""},
+		{".1.3.6.1.2.1.31.1.1.1.6", ".1.3.6.1.2.1.31.1.1.1.6", "Counter64", "Counter64", "octets"},
+	} {
+		oid, node, err := ResolveOID(c.query)
+		if err != nil {
+			t.Errorf("%s: %s", c.query, err)
+			continue
+		}
+		if oid != c.oid || node == nil || node.Syntax != c.syntax || node.Base != c.base || node.Units != c.units {
+			t.Errorf("%s: %s %+v", c.query, oid, node)
+		}
+	}
+
+	if _, _, err := ResolveOID("IF-MIB::onuName"); err == nil {
+		t.Errorf("object of other module is resolved")
+	}
+	if node := LookupMibOID(".1.3.6.1.2.1.31.1.1.1.6.5"); node == nil || node.Name != "ifHCInOctets" {
+		t.Errorf("lookup: %+v", node)
+	}
+	if warn := mibModules["IF-MIB"]["ifHCInOctets"].CheckTemplate("GAUGE", false); warn == "" {
+		t.Errorf("counter with GAUGE template has no warning")
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	h "github.com/a4lex/go-helpers"
+)
+
+//
+// Notifications - messages are sent through channels configured in `notifiers` section
+// of config.yml, every channel gets only messages of own severities
+//
+
+const (
+	notifyQueueSize   = 256
+	notifyTimeout     = 10 * time.Second
+	notifyTemplate    = `{{.Subject}}{{if .Text}}` + "\n" + `{{.Text}}{{end}}`
+	notifyTelegramAPI = "https://api.telegram.org"
+)
+
+//
+// Message struct for store notification
+//
+type Message struct {
+	Severity string    `json:"severity"`
+	Subject  string    `json:"subject"`
+	Text     string    `json:"text"`
+	Alert    *Alert    `json:"alert,omitempty"` // nil for messages not related to thresholds
+	Time     time.Time `json:"time"`
+}
+
+//
+// Notifier interface for send notification by one channel
+//
+type Notifier interface {
+	Notify(m *Message, text string) error
+}
+
+//
+// NotifierConfig struct for store notifier configs from config.yml
+//
+type NotifierConfig struct {
+	Type     string   `yaml:"type"`
+	Severity []string `yaml:"severity"` // send only messages with given severities, default - all
+	Template string   `yaml:"template"` // text/template of message, fields: Severity, Subject, Text, Alert, Time
+	URL      string   `yaml:"url"`      // webhook, slack: endpoint, telegram: API url
+	Addr     string   `yaml:"addr"`     // smtp: host:port
+	User     string   `yaml:"user"`     // smtp: user for PLAIN auth
+	Pass     string   `yaml:"pass"`     // smtp: password
+	From     string   `yaml:"from"`     // smtp: sender
+	To       []string `yaml:"to"`       // smtp: recipients
+	Token    string   `yaml:"token"`    // telegram: bot token
+	ChatID   string   `yaml:"chat_id"`  // telegram: chat for messages
+}
+
+//
+// Notifiers list of notification routes, messages are sent in background
+//
+type Notifiers struct {
+	routes []*notifyRoute
+	queue  chan *Message
+	wg     sync.WaitGroup
+}
+
+type notifyRoute struct {
+	name     string
+	notifier Notifier
+	severity map[string]bool
+	template *template.Template
+}
+
+var notifierFactories = map[string]func(NotifierConfig) (Notifier, error){
+	"smtp":     NewSMTPNotifier,
+	"webhook":  NewWebhookNotifier,
+	"telegram": NewTelegramNotifier,
+	"slack":    NewSlackNotifier,
+}
+
+//
+// InitNotifiers - create all notifiers from config and start sender
+//
+func InitNotifiers(configs []NotifierConfig) (*Notifiers, error) {
+	n := &Notifiers{queue: make(chan *Message, notifyQueueSize)}
+
+	for _, c := range configs {
+		factory, ok := notifierFactories[c.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown notifier type: %s", c.Type)
+		}
+
+		notifier, err := factory(c)
+		if err != nil {
+			return nil, fmt.Errorf("can not init notifier %s: %s", c.Type, err)
+		}
+
+		if c.Template == "" {
+			c.Template = notifyTemplate
+		}
+		route := &notifyRoute{name: c.Type, notifier: notifier, severity: make(map[string]bool)}
+		if route.template, err = template.New(c.Type).Parse(c.Template); err != nil {
+			return nil, fmt.Errorf("bad template of notifier %s: %s", c.Type, err)
+		}
+		for _, severity := range c.Severity {
+			route.severity[severity] = true
+		}
+
+		n.routes = append(n.routes, route)
+		l.Printf(h.INFO, "Init notifier: %s, severity: %s", c.Type, strings.Join(c.Severity, ","))
+	}
+
+	n.wg.Add(1)
+	go n.send()
+
+	return n, nil
+}
+
+//
+// Send - queue notification for all routes of its severity
+//
+func (n *Notifiers) Send(severity, subject, text string) {
+	n.push(&Message{Severity: severity, Subject: subject, Text: text, Time: time.Now()})
+}
+
+//
+// SendAlert - queue notification about raise/clear of threshold alert
+//
+func (n *Notifiers) SendAlert(a *Alert) {
+	subject := fmt.Sprintf("[%s] %s %s: device %s", strings.ToUpper(a.Severity), a.Path, a.State, a.DeviceID)
+	if a.IfaceID != "" {
+		subject += ", iface " + a.IfaceID
+	}
+	text := fmt.Sprintf("value %g, threshold %s, at %s", a.Value, a.Threshold, a.Time.Format("2006-01-02 15:04:05"))
+
+	n.push(&Message{Severity: a.Severity, Subject: subject, Text: text, Alert: a, Time: a.Time})
+}
+
+//
+// push - queue message, it is dropped if queue is full (channels are down or slow),
+// robot should not wait for notifications
+//
+func (n *Notifiers) push(m *Message) {
+	select {
+	case n.queue <- m:
+	default:
+		l.Printf(h.ERROR, "Notification queue is full, message is dropped: %s", m.Subject)
+	}
+}
+
+//
+// Close - send all queued messages and stop sender
+//
+func (n *Notifiers) Close() {
+	close(n.queue)
+	n.wg.Wait()
+}
+
+func (n *Notifiers) send() {
+	defer n.wg.Done()
+
+	for m := range n.queue {
+		for _, route := range n.routes {
+			if len(route.severity) > 0 && !route.severity[m.Severity] {
+				continue
+			}
+
+			var text bytes.Buffer
+			if err := route.template.Execute(&text, m); err != nil {
+				l.Printf(h.ERROR, "Can not render message for %s: %s", route.name, err)
+				continue
+			}
+			if err := route.notifier.Notify(m, text.String()); err != nil {
+				l.Printf(h.ERROR, "Can not send message by %s: %s", route.name, err)
+				continue
+			}
+			l.Printf(h.DEBUG, "Send message by %s: %s", route.name, m.Subject)
+		}
+	}
+}
+
+//
+// SMTPNotifier send messages by email
+//
+type SMTPNotifier struct {
+	addr string
+	auth smtp.Auth
+	from string
+	to   []string
+}
+
+//
+// NewSMTPNotifier - return notifier for send email through SMTP server
+//
+func NewSMTPNotifier(c NotifierConfig) (Notifier, error) {
+	if c.Addr == "" || c.From == "" || len(c.To) == 0 {
+		return nil, fmt.Errorf("addr, from and to are required")
+	}
+
+	s := &SMTPNotifier{addr: c.Addr, from: c.From, to: c.To}
+	if c.User != "" {
+		s.auth = smtp.PlainAuth("", c.User, c.Pass, strings.Split(c.Addr, ":")[0])
+	}
+	return s, nil
+}
+
+//
+// Notify - send email with rendered message
+//
+func (s *SMTPNotifier) Notify(m *Message, text string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", m.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(text, "\n", "\r\n", -1))
+
+	return s.send(msg.Bytes())
+}
+
+//
+// send - same as smtp.SendMail, but whole session is limited by notifyTimeout
+//
+func (s *SMTPNotifier) send(msg []byte) error {
+	conn, err := net.DialTimeout("tcp", s.addr, notifyTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(notifyTimeout)); err != nil {
+		return err
+	}
+
+	host := strings.Split(s.addr, ":")[0]
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("smtp: server doesn't support AUTH")
+		}
+		if err = c.Auth(s.auth); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(s.from); err != nil {
+		return err
+	}
+	for _, to := range s.to {
+		if err = c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+//
+// HTTPNotifier send messages as JSON by HTTP POST
+//
+type HTTPNotifier struct {
+	url  string
+	body func(m *Message, text string) interface{}
+}
+
+//
+// NewWebhookNotifier - return notifier for POST message with all fields to URL
+//
+func NewWebhookNotifier(c NotifierConfig) (Notifier, error) {
+	if c.URL == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+	return &HTTPNotifier{url: c.URL, body: func(m *Message, text string) interface{} {
+		return struct {
+			*Message
+			Body string `json:"message"`
+		}{m, text}
+	}}, nil
+}
+
+//
+// NewSlackNotifier - return notifier for Slack (or compatible) incoming webhook
+//
+func NewSlackNotifier(c NotifierConfig) (Notifier, error) {
+	if c.URL == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+	return &HTTPNotifier{url: c.URL, body: func(m *Message, text string) interface{} {
+		return map[string]string{"text": text}
+	}}, nil
+}
+
+//
+// NewTelegramNotifier - return notifier for Telegram bot API
+//
+func NewTelegramNotifier(c NotifierConfig) (Notifier, error) {
+	if c.Token == "" || c.ChatID == "" {
+		return nil, fmt.Errorf("token and chat_id are required")
+	}
+	if c.URL == "" {
+		c.URL = notifyTelegramAPI
+	}
+	return &HTTPNotifier{
+		url: fmt.Sprintf("%s/bot%s/sendMessage", strings.TrimRight(c.URL, "/"), c.Token),
+		body: func(m *Message, text string) interface{} {
+			return map[string]string{"chat_id": c.ChatID, "text": text}
+		}}, nil
+}
+
+//
+// Notify - POST message as JSON
+//
+func (hn *HTTPNotifier) Notify(m *Message, text string) error {
+	body, err := json.Marshal(hn.body(m, text))
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(hn.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// do not log url, it can contain token of bot
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("responce status: %s", resp.Status)
+	}
+	return nil
+}
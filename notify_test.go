@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+//
+// notifyTestServer - HTTP server which saves path and JSON body of requests
+//
+type notifyTestServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	paths    []string
+	bodies   []map[string]interface{}
+	response int
+}
+
+func newNotifyTestServer(t *testing.T) *notifyTestServer {
+	s := &notifyTestServer{response: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		data, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &body); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("bad request: %s %s", r.Header.Get("Content-Type"), data)
+		}
+		s.mu.Lock()
+		s.paths = append(s.paths, r.URL.Path)
+		s.bodies = append(s.bodies, body)
+		w.WriteHeader(s.response)
+		s.mu.Unlock()
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func notifyTestMessage() *Message {
+	return &Message{Severity: "critical", Subject: "link down", Text: "iface 10", Time: time.Unix(1600000000, 0)}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	s := newNotifyTestServer(t)
+	n, err := NewWebhookNotifier(NotifierConfig{URL: s.URL + "/hook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = n.Notify(notifyTestMessage(), "link down\niface 10"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.bodies) != 1 || s.paths[0] != "/hook" {
+		t.Fatalf("requests: %v", s.paths)
+	}
+	body := s.bodies[0]
+	if body["severity"] != "critical" || body["subject"] != "link down" || body["text"] != "iface 10" ||
+		body["message"] != "link down\niface 10" {
+		t.Errorf("body: %v", body)
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	s := newNotifyTestServer(t)
+	n, err := NewSlackNotifier(NotifierConfig{URL: s.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = n.Notify(notifyTestMessage(), "link down"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.bodies) != 1 || len(s.bodies[0]) != 1 || s.bodies[0]["text"] != "link down" {
+		t.Errorf("bodies: %v", s.bodies)
+	}
+}
+
+func TestTelegramNotifier(t *testing.T) {
+	s := newNotifyTestServer(t)
+	if _, err := NewTelegramNotifier(NotifierConfig{URL: s.URL, Token: "123:abc"}); err == nil {
+		t.Errorf("notifier without chat_id is created")
+	}
+
+	n, err := NewTelegramNotifier(NotifierConfig{URL: s.URL + "/", Token: "123:abc", ChatID: "-100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = n.Notify(notifyTestMessage(), "link down"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.bodies) != 1 || s.paths[0] != "/bot123:abc/sendMessage" {
+		t.Fatalf("requests: %v", s.paths)
+	}
+	if s.bodies[0]["chat_id"] != "-100" || s.bodies[0]["text"] != "link down" {
+		t.Errorf("body: %v", s.bodies[0])
+	}
+
+	// error should not contain url with token
+	s.response = http.StatusUnauthorized
+	if err = n.Notify(notifyTestMessage(), "link down"); err == nil || strings.Contains(err.Error(), "abc") {
+		t.Errorf("error: %v", err)
+	}
+}
+
+//
+// notifyTestSMTP - SMTP server for one session, returns commands and data of message
+//
+func notifyTestSMTP(t *testing.T) (string, chan []string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	session := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var lines []string
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost ESMTP")
+		for data := false; ; {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			line = strings.TrimRight(line, "\r\n")
+			lines = append(lines, line)
+
+			switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); {
+			case data && line == ".":
+				data = false
+				reply("250 queued")
+			case data:
+			case cmd == "EHLO":
+				reply("250-localhost")
+				reply("250 8BITMIME")
+			case cmd == "DATA":
+				data = true
+				reply("354 go ahead")
+			case cmd == "QUIT":
+				reply("221 bye")
+				session <- lines
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+		session <- lines
+	}()
+	return ln.Addr().String(), session
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	if _, err := NewSMTPNotifier(NotifierConfig{Addr: "localhost:25", From: "robot@localhost"}); err == nil {
+		t.Errorf("notifier without recipients is created")
+	}
+
+	addr, session := notifyTestSMTP(t)
+	n, err := NewSMTPNotifier(NotifierConfig{Addr: addr, From: "robot@localhost", To: []string{"noc@localhost", "admin@localhost"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = n.Notify(notifyTestMessage(), "link down\niface 10"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Join(<-session, "\n")
+	for _, expected := range []string{
+		"MAIL FROM:<robot@localhost>", "RCPT TO:<noc@localhost>", "RCPT TO:<admin@localhost>",
+		"To: noc@localhost, admin@localhost", "Subject: link down", "link down\niface 10\n.", "QUIT",
+	} {
+		if !strings.Contains(lines, expected) {
+			t.Errorf("session has no %q:\n%s", expected, lines)
+		}
+	}
+}
+
+func TestSMTPNotifierTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("wait for timeout of notifier")
+	}
+
+	// server accepts connection, but does not answer
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			defer conn.Close()
+			ioutil.ReadAll(conn)
+		}
+	}()
+
+	n, _ := NewSMTPNotifier(NotifierConfig{Addr: ln.Addr().String(), From: "robot@localhost", To: []string{"noc@localhost"}})
+	start := time.Now()
+	if err = n.Notify(notifyTestMessage(), "link down"); err == nil {
+		t.Errorf("message is sent to silent server")
+	}
+	if d := time.Since(start); d > notifyTimeout+time.Second {
+		t.Errorf("notify took %s", d)
+	}
+}
+
+type notifyTestBlocked struct {
+	release chan struct{}
+	mu      sync.Mutex
+	count   int
+}
+
+func (b *notifyTestBlocked) Notify(m *Message, text string) error {
+	<-b.release
+	b.mu.Lock()
+	b.count++
+	b.mu.Unlock()
+	return nil
+}
+
+func TestNotifiersQueueFull(t *testing.T) {
+	blocked := &notifyTestBlocked{release: make(chan struct{})}
+	n := &Notifiers{queue: make(chan *Message, notifyQueueSize)}
+	n.routes = append(n.routes, &notifyRoute{name: "test", notifier: blocked, severity: map[string]bool{},
+		template: template.Must(template.New("test").Parse(notifyTemplate))})
+	n.wg.Add(1)
+	go n.send()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < notifyQueueSize+10; i++ {
+			n.Send("warning", "test", "")
+		}
+		n.SendAlert(&Alert{Severity: "critical", Path: "test", State: "raise", Time: time.Now()})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send is blocked by full queue")
+	}
+
+	close(blocked.release)
+	n.Close()
+	if blocked.count > notifyQueueSize+1 {
+		t.Errorf("sent %d messages, queue size is %d", blocked.count, notifyQueueSize)
+	}
+}
+
+func TestNotifiersSeverity(t *testing.T) {
+	s := newNotifyTestServer(t)
+	n, err := InitNotifiers([]NotifierConfig{
+		{Type: "slack", URL: s.URL, Severity: []string{"critical"}, Template: "{{.Severity}}: {{.Subject}}"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Send("warning", "cpu", "")
+	n.Send("critical", "link down", "")
+	n.Close()
+
+	if len(s.bodies) != 1 || s.bodies[0]["text"] != "critical: link down" {
+		t.Errorf("bodies: %v", s.bodies)
+	}
+
+	if _, err = InitNotifiers([]NotifierConfig{{Type: "pager"}}); err == nil {
+		t.Errorf("unknown notifier is created")
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	h "github.com/a4lex/go-helpers"
+)
+
+//
+// Thresholds of snmp_templates.threshold, rules are separated by ';':
+//   <op><raise>[,<clear>][/<hold>][@<severity>]
+//   op       - '>' (alert on high value) or '<' (alert on low value)
+//   clear    - value for clear alert (hysteresis), default - raise value
+//   hold     - count of checks in a row for change state, default - 1
+//   severity - default - warning
+// e.g. ">80,70/3@warning;>95,90/2@critical"
+//
+
+const (
+	sqlGetAlertStates = `SELECT state_key, raised, hold_count FROM alert_states`
+	sqlSetAlertState  = `INSERT INTO alert_states (state_key, raised, hold_count, updated_at) VALUES (?, ?, ?, NOW()) ` +
+		`ON DUPLICATE KEY UPDATE raised=VALUE(raised), hold_count=VALUE(hold_count), updated_at=NOW()`
+	sqlDelAlertState = `DELETE FROM alert_states WHERE state_key = ?`
+	sqlInsertAlert   = `INSERT INTO alerts (device_id, iface_id, path, severity, state, value, threshold, created_at) ` +
+		`VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+)
+
+//
+// Threshold struct for store one rule of template threshold
+//
+type Threshold struct {
+	rule     string
+	op       byte
+	raise    float64
+	clear    float64
+	hold     int
+	severity string
+}
+
+//
+// Alert struct for store raise/clear event of threshold
+//
+type Alert struct {
+	DeviceID  string    `json:"device_id"`
+	IfaceID   string    `json:"iface_id,omitempty"`
+	Path      string    `json:"path"`
+	Severity  string    `json:"severity"`
+	State     string    `json:"state"` // raise or clear
+	Value     float64   `json:"value"`
+	Threshold string    `json:"threshold"`
+	Time      time.Time `json:"time"`
+}
+
+type alertState struct {
+	raised bool
+	count  int
+}
+
+var (
+	alertMu     sync.Mutex
+	alertStates = make(map[string]*alertState)
+)
+
+//
+// ParseThresholds - parse threshold rules of template
+//
+func ParseThresholds(s string) ([]*Threshold, error) {
+	thresholds := make([]*Threshold, 0)
+
+	for _, rule := range strings.Split(s, ";") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+
+		th := &Threshold{rule: rule, hold: 1, severity: "warning"}
+		if th.op = rule[0]; th.op != '>' && th.op != '<' {
+			return nil, fmt.Errorf("bad threshold operator: %s", rule)
+		}
+		rule = rule[1:]
+
+		var err error
+		if i := strings.LastIndex(rule, "@"); i >= 0 {
+			th.severity, rule = strings.TrimSpace(rule[i+1:]), rule[:i]
+			// severity is part of key of alert state
+			if th.severity == "" || strings.ContainsAny(th.severity, "/ ") {
+				return nil, fmt.Errorf("bad threshold severity: %s", th.rule)
+			}
+		}
+		if i := strings.LastIndex(rule, "/"); i >= 0 {
+			if th.hold, err = strconv.Atoi(strings.TrimSpace(rule[i+1:])); err != nil || th.hold < 1 {
+				return nil, fmt.Errorf("bad threshold hold count: %s", th.rule)
+			}
+			rule = rule[:i]
+		}
+		values := strings.SplitN(rule, ",", 2)
+		if th.raise, err = strconv.ParseFloat(strings.TrimSpace(values[0]), 64); err != nil {
+			return nil, fmt.Errorf("bad threshold value: %s", th.rule)
+		}
+		th.clear = th.raise
+		if len(values) == 2 {
+			if th.clear, err = strconv.ParseFloat(strings.TrimSpace(values[1]), 64); err != nil {
+				return nil, fmt.Errorf("bad threshold clear value: %s", th.rule)
+			}
+		}
+		if (th.op == '>' && th.clear > th.raise) || (th.op == '<' && th.clear < th.raise) {
+			return nil, fmt.Errorf("clear value is out of hysteresis range: %s", th.rule)
+		}
+
+		thresholds = append(thresholds, th)
+	}
+
+	return thresholds, nil
+}
+
+//
+// key - identity of rule in key of alert state, state is kept while hysteresis or hold is edited
+// and rules are reordered
+//
+func (th *Threshold) key() string {
+	return fmt.Sprintf("%c%g@%s", th.op, th.raise, th.severity)
+}
+
+//
+// breached - return true if value is in alert zone, clear value is used for raised alert
+//
+func (th *Threshold) breached(val float64, raised bool) bool {
+	limit := th.raise
+	if raised {
+		limit = th.clear
+	}
+	if th.op == '>' {
+		return val > limit
+	}
+	return val < limit
+}
+
+//
+// LoadAlertStates - load raised and pending alert states from DB
+//
+func LoadAlertStates() {
+	alertMu.Lock()
+	defer alertMu.Unlock()
+
+	alertStates = make(map[string]*alertState)
+	for _, row := range mysqli.DBSelectList(sqlGetAlertStates) {
+		count, _ := strconv.Atoi(row["hold_count"])
+		alertStates[row["state_key"]] = &alertState{raised: row["raised"] == "1", count: count}
+	}
+}
+
+//
+// CheckThresholds - check value of series by thresholds, store state changes and alerts
+//
+func CheckThresholds(s *Series, thresholds []*Threshold, val float64, t time.Time) {
+	for _, th := range thresholds {
+		key := fmt.Sprintf("%s/%s/%s/%s", s.DeviceID, s.IfaceID, s.Path, th.key())
+
+		alertMu.Lock()
+		st, ok := alertStates[key]
+		if !ok {
+			st = &alertState{}
+			alertStates[key] = st
+		}
+		prev := *st
+
+		// state is changed only after hold checks in a row
+		if th.breached(val, st.raised) != st.raised {
+			st.count++
+		} else {
+			st.count = 0
+		}
+
+		var alert *Alert
+		if st.count >= th.hold {
+			st.raised, st.count = !st.raised, 0
+			alert = &Alert{DeviceID: s.DeviceID, IfaceID: s.IfaceID, Path: s.Path, Severity: th.severity,
+				State: "clear", Value: val, Threshold: th.rule, Time: t}
+			if st.raised {
+				alert.State = "raise"
+			}
+		}
+		cur := *st
+		if !cur.raised && cur.count == 0 {
+			delete(alertStates, key)
+		}
+		alertMu.Unlock()
+
+		if cur != prev {
+			if !cur.raised && cur.count == 0 {
+				mysqli.DBQuery(sqlDelAlertState, key)
+			} else {
+				mysqli.DBQuery(sqlSetAlertState, key, cur.raised, cur.count)
+			}
+		}
+
+		if alert != nil {
+			storeAlert(alert)
+		}
+	}
+}
+
+//
+// ExpireAlertStates - drop states of device which are not checked any more: template or rule
+// is removed (or its op, raise value or severity is changed), iface is deactivated. Raised alert
+// is cleared. Only states of ifaces (ifaces is true) or of device itself are expired, alive is
+// called only if device has such states and returns thresholds of its series by "<iface id>/<path>"
+//
+func ExpireAlertStates(deviceID string, ifaces bool, alive func() map[string][]*Threshold, t time.Time) {
+	prefix := deviceID + "/"
+
+	alertMu.Lock()
+	keys := make([]string, 0)
+	for key := range alertStates {
+		if strings.HasPrefix(key, prefix) && strings.HasPrefix(key, prefix+"/") != ifaces {
+			keys = append(keys, key)
+		}
+	}
+	alertMu.Unlock()
+	if len(keys) == 0 {
+		return
+	}
+
+	thresholds := alive()
+LOOP_STATES:
+	for _, key := range keys {
+		i := strings.LastIndex(key, "/")
+		series, rule := key[len(prefix):i], key[i+1:]
+		for _, th := range thresholds[series] {
+			if th.key() == rule {
+				continue LOOP_STATES
+			}
+		}
+
+		alertMu.Lock()
+		st := alertStates[key]
+		delete(alertStates, key)
+		alertMu.Unlock()
+		mysqli.DBQuery(sqlDelAlertState, key)
+
+		if st == nil || !st.raised {
+			continue
+		}
+		// severity of state with key of old format (index of rule) is unknown
+		severity := "warning"
+		if j := strings.LastIndex(rule, "@"); j >= 0 {
+			severity = rule[j+1:]
+		}
+		j := strings.Index(series, "/")
+		storeAlert(&Alert{DeviceID: deviceID, IfaceID: series[:j], Path: series[j+1:], Severity: severity,
+			State: "clear", Threshold: rule, Time: t})
+	}
+}
+
+//
+// storeAlert - write alert to DB and send it to notifiers
+//
+func storeAlert(alert *Alert) {
+	l.Printf(h.INFO, "Alert %s [%s]: device %s, iface %s, %s = %g, threshold %s",
+		alert.State, alert.Severity, alert.DeviceID, alert.IfaceID, alert.Path, alert.Value, alert.Threshold)
+	var ifaceID interface{}
+	if alert.IfaceID != "" {
+		ifaceID = alert.IfaceID
+	}
+	mysqli.DBQuery(sqlInsertAlert, alert.DeviceID, ifaceID, alert.Path, alert.Severity,
+		alert.State, alert.Value, alert.Threshold, alert.Time)
+	notifiers.SendAlert(alert)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	h "github.com/a4lex/go-helpers"
+)
+
+//
+// alertTestInit - reset states, DB writes fail (no server) and alerts are queued in returned channel
+//
+func alertTestInit(t *testing.T) chan *Message {
+	var err error
+	if mysqli, err = h.DBConnect(&l, "tcp(127.0.0.1:1)", "test", "test", "test", "?timeout=100ms", 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	notifiers = &Notifiers{queue: make(chan *Message, notifyQueueSize)}
+	alertStates = make(map[string]*alertState)
+	return notifiers.queue
+}
+
+func alertTestStates(queue chan *Message) []string {
+	states := make([]string, 0)
+	for {
+		select {
+		case m := <-queue:
+			states = append(states, m.Alert.State+" "+m.Alert.Severity+" "+m.Alert.Threshold)
+		default:
+			return states
+		}
+	}
+}
+
+func TestParseThresholds(t *testing.T) {
+	thresholds, err := ParseThresholds(" >80,70/3@critical ; <10 ;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thresholds) != 2 {
+		t.Fatalf("thresholds: %v", thresholds)
+	}
+	if th := *thresholds[0]; th.op != '>' || th.raise != 80 || th.clear != 70 || th.hold != 3 || th.severity != "critical" {
+		t.Errorf("threshold: %+v", th)
+	}
+	if th := *thresholds[1]; th.op != '<' || th.raise != 10 || th.clear != 10 || th.hold != 1 || th.severity != "warning" {
+		t.Errorf("threshold: %+v", th)
+	}
+
+	for _, rule := range []string{
+		"=80", "80", ">", ">x", ">80,x", ">80/0", ">80/x", ">80,90", "<10,5", ">80@", ">80@a/b",
+	} {
+		if _, err := ParseThresholds(rule); err == nil {
+			t.Errorf("bad rule %q is parsed", rule)
+		}
+	}
+}
+
+func TestCheckThresholds(t *testing.T) {
+	for _, c := range []struct {
+		rule   string
+		values []float64
+		states []string
+	}{
+		{">80", []float64{50, 90, 95, 70}, []string{"raise warning >80", "clear warning >80"}},
+		{">80,70/2@critical", []float64{90, 50, 90, 90, 75, 65, 90, 65, 65},
+			[]string{"raise critical >80,70/2@critical", "clear critical >80,70/2@critical"}},
+		{"<10/3", []float64{5, 5, 20, 5, 5, 5, 5}, []string{"raise warning <10/3"}},
+	} {
+		queue := alertTestInit(t)
+		thresholds, err := ParseThresholds(c.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Series{Path: "device/cpu", DeviceID: "1"}
+		for _, val := range c.values {
+			CheckThresholds(s, thresholds, val, time.Now())
+		}
+
+		if states := alertTestStates(queue); strings.Join(states, ";") != strings.Join(c.states, ";") {
+			t.Errorf("%s %v: alerts %q, expected %q", c.rule, c.values, states, c.states)
+		}
+	}
+}
+
+func TestAlertStateKeepsRule(t *testing.T) {
+	queue := alertTestInit(t)
+	s := &Series{Path: "device/cpu", DeviceID: "1"}
+
+	thresholds, _ := ParseThresholds(">80,70@critical;>50")
+	CheckThresholds(s, thresholds, 90, time.Now())
+
+	// clear value is changed and rules are reordered, raised alerts are not raised again
+	thresholds, _ = ParseThresholds(">50;>80,60/2@critical")
+	CheckThresholds(s, thresholds, 85, time.Now())
+	CheckThresholds(s, thresholds, 65, time.Now())
+
+	if states := alertTestStates(queue); len(states) != 2 || states[0] != "raise critical >80,70@critical" ||
+		states[1] != "raise warning >50" {
+		t.Errorf("alerts: %q", states)
+	}
+	if len(alertStates) != 2 {
+		t.Errorf("states: %v", alertStates)
+	}
+}
+
+func TestExpireAlertStates(t *testing.T) {
+	queue := alertTestInit(t)
+	thresholds, _ := ParseThresholds(">80@critical;>50")
+	down, _ := ParseThresholds(">0")
+
+	CheckThresholds(&Series{Path: "device/cpu", DeviceID: "1"}, thresholds, 60, time.Now())
+	CheckThresholds(&Series{Path: "iface/in", DeviceID: "1", IfaceID: "10"}, thresholds, 90, time.Now())
+	CheckThresholds(&Series{Path: "iface/down", DeviceID: "1", IfaceID: "11"}, down, 1, time.Now())
+	CheckThresholds(&Series{Path: "device/cpu", DeviceID: "12"}, thresholds, 90, time.Now())
+	alertTestStates(queue)
+
+	// rule >50 is removed, states of ifaces are not touched
+	ExpireAlertStates("1", false, func() map[string][]*Threshold {
+		return map[string][]*Threshold{"/device/cpu": thresholds[:1]}
+	}, time.Now())
+	if states := alertTestStates(queue); len(states) != 1 || states[0] != "clear warning >50@warning" {
+		t.Errorf("alerts: %q", states)
+	}
+
+	// iface 11 is deactivated
+	ExpireAlertStates("1", true, func() map[string][]*Threshold {
+		return map[string][]*Threshold{"10/iface/in": thresholds, "10/iface/down": down}
+	}, time.Now())
+	if states := alertTestStates(queue); len(states) != 1 || states[0] != "clear warning >0@warning" {
+		t.Errorf("alerts: %q", states)
+	}
+
+	// device without states does not load alive series
+	ExpireAlertStates("2", false, func() map[string][]*Threshold {
+		t.Errorf("alive series are loaded for device without states")
+		return nil
+	}, time.Now())
+
+	if len(alertStates) != 4 {
+		t.Errorf("states: %v", alertStates)
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+
+	h "github.com/a4lex/go-helpers"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+//
+// CLI sessions - OLT CLI is reached by telnet or SSH, both have semantics of h.MyTelnet: calls are
+// chained, any error closes session, which is checked by IsConnected after chain
+//
+
+var (
+	cliTransport  = flag.String("cli", "telnet", "CLI transport for Epon without own cli_transport [ telnet, ssh ]")
+	sshPort       = flag.Int("ssh-port", 22, "SSH port of OLT CLI")
+	sshKey        = flag.String("ssh-key", "", "Private key for SSH auth (not encrypted), password of credential is tried too")
+	sshKnownHosts = flag.String("ssh-known-hosts", "", "known_hosts file for check host keys of OLT, required for SSH")
+)
+
+//
+// CliSession interface of OLT CLI session
+//
+type CliSession interface {
+	Expect(delim ...string) CliSession
+	SendLine(command string, args ...interface{}) CliSession
+	ReadUntil(delim byte) CliSession
+	FindAllStringSubmatch(re *regexp.Regexp) [][]string
+	FindAllString(re *regexp.Regexp) []string
+	IsConnected() bool
+	Reconnect() CliSession
+	Close()
+}
+
+//
+// CliConnect - open CLI session to OLT by transport, SSH session is authorized by login/password
+// or key, telnet session should be authorized by dialog
+//
+func CliConnect(transport, ip, login, password string, timeout time.Duration, logger func(string)) (CliSession, string, error) {
+	switch transport {
+	case "", "telnet":
+		addr := fmt.Sprintf("%s:23", ip)
+		t, err := h.TelnetConnect("tcp", addr, timeout, logger)
+		if err != nil {
+			return nil, addr, err
+		}
+		t.SetUnixWriteMode(true)
+		return &telnetSession{t}, addr, nil
+
+	case "ssh":
+		addr := fmt.Sprintf("%s:%d", ip, *sshPort)
+		config, err := sshClientConfig(login, password, timeout)
+		if err != nil {
+			return nil, addr, err
+		}
+		s, err := SSHConnect("tcp", addr, config, timeout, logger)
+		return s, addr, err
+	}
+	return nil, ip, fmt.Errorf("unknown CLI transport: %s", transport)
+}
+
+//
+// telnetSession - CLI session over telnet of helpers
+//
+type telnetSession struct {
+	t *h.MyTelnet
+}
+
+func (s *telnetSession) Expect(delim ...string) CliSession {
+	s.t.Expect(delim...)
+	return s
+}
+
+func (s *telnetSession) SendLine(command string, args ...interface{}) CliSession {
+	s.t.SendLine(command, args...)
+	return s
+}
+
+func (s *telnetSession) ReadUntil(delim byte) CliSession {
+	s.t.ReadUntil(delim)
+	return s
+}
+
+func (s *telnetSession) FindAllStringSubmatch(re *regexp.Regexp) [][]string {
+	return s.t.FindAllStringSubmatch(re)
+}
+
+func (s *telnetSession) FindAllString(re *regexp.Regexp) []string {
+	return s.t.FindAllString(re)
+}
+
+func (s *telnetSession) IsConnected() bool {
+	return s.t.IsConnected()
+}
+
+func (s *telnetSession) Reconnect() CliSession {
+	s.t.Reconnect()
+	return s
+}
+
+func (s *telnetSession) Close() {
+	s.t.Close()
+	s.t.Conn.Close()
+}
+
+//
+// SSHSession - CLI session over interactive shell of SSH
+//
+type SSHSession struct {
+	network   string
+	addr      string
+	config    *ssh.ClientConfig
+	timeout   time.Duration
+	logger    func(string)
+	connected bool
+	lineData  string
+
+	client  *ssh.Client
+	session *ssh.Session
+	stdin   io.Writer
+
+	mu      sync.Mutex
+	buf     []byte        // output of shell which is not read yet
+	readErr error         // error of output, e.g. EOF
+	notify  chan struct{} // new output or error
+}
+
+//
+// SSHConnect - connect to SSH server and start shell with pty
+//
+func SSHConnect(network, addr string, config *ssh.ClientConfig, timeout time.Duration, logger func(string)) (*SSHSession, error) {
+	s := &SSHSession{network: network, addr: addr, config: config, timeout: timeout, logger: logger}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SSHSession) connect() error {
+	conn, err := net.DialTimeout(s.network, s.addr, s.timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(s.timeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, s.addr, s.config)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(c, chans, reqs)
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return err
+	}
+	stdin, err := session.StdinPipe()
+	if err == nil {
+		var stdout io.Reader
+		if stdout, err = session.StdoutPipe(); err == nil {
+			session.Stderr = ioutil.Discard
+			if err = session.RequestPty("vt100", 0, 512, ssh.TerminalModes{ssh.ECHO: 0}); err == nil {
+				err = session.Shell()
+			}
+			s.mu.Lock()
+			s.buf, s.readErr, s.notify = nil, nil, make(chan struct{}, 1)
+			s.mu.Unlock()
+			go s.read(stdout, s.notify)
+		}
+	}
+	if err != nil {
+		session.Close()
+		client.Close()
+		return err
+	}
+
+	s.client, s.session, s.stdin, s.connected = client, session, stdin, true
+	return nil
+}
+
+//
+// read - collect output of shell till it is closed
+//
+func (s *SSHSession) read(stdout io.Reader, notify chan struct{}) {
+	chunk := make([]byte, 4096)
+	for {
+		n, err := stdout.Read(chunk)
+		s.mu.Lock()
+		if notify != s.notify {
+			// session was reconnected
+			s.mu.Unlock()
+			return
+		}
+		s.buf = append(s.buf, chunk[:n]...)
+		if err != nil {
+			s.readErr = err
+		}
+		s.mu.Unlock()
+
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+//
+// readFunc - wait for output matched by match (it returns end of match or -1) and cut it from output
+//
+func (s *SSHSession) readFunc(match func(data []byte) int) ([]byte, error) {
+	timeout := time.NewTimer(s.timeout)
+	defer timeout.Stop()
+
+	for {
+		s.mu.Lock()
+		if end := match(s.buf); end >= 0 {
+			data := s.buf[:end]
+			s.buf = s.buf[end:]
+			s.mu.Unlock()
+			return data, nil
+		}
+		err, notify := s.readErr, s.notify
+		s.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-notify:
+		case <-timeout.C:
+			return nil, fmt.Errorf("read %s: i/o timeout", s.addr)
+		}
+	}
+}
+
+func (s *SSHSession) Expect(delim ...string) CliSession {
+	if s.connected {
+		_, err := s.readFunc(func(data []byte) int {
+			end := -1
+			for _, d := range delim {
+				if i := bytes.Index(data, []byte(d)); i >= 0 && (end < 0 || i+len(d) < end) {
+					end = i + len(d)
+				}
+			}
+			return end
+		})
+		s.isSuccess(err)
+	}
+	return s
+}
+
+func (s *SSHSession) SendLine(command string, args ...interface{}) CliSession {
+	if s.connected {
+		_, err := io.WriteString(s.stdin, fmt.Sprintf(command+"\n", args...))
+		s.isSuccess(err)
+	}
+	return s
+}
+
+func (s *SSHSession) ReadUntil(delim byte) CliSession {
+	if s.connected {
+		data, err := s.readFunc(func(data []byte) int {
+			if i := bytes.IndexByte(data, delim); i >= 0 {
+				return i + 1
+			}
+			return -1
+		})
+		if s.isSuccess(err) {
+			s.lineData = string(data)
+		}
+	}
+	return s
+}
+
+func (s *SSHSession) FindAllStringSubmatch(re *regexp.Regexp) [][]string {
+	if s.connected {
+		return re.FindAllStringSubmatch(s.lineData, -1)
+	}
+	return [][]string{}
+}
+
+func (s *SSHSession) FindAllString(re *regexp.Regexp) []string {
+	if s.connected {
+		return re.FindAllString(s.lineData, -1)
+	}
+	return []string{}
+}
+
+func (s *SSHSession) IsConnected() bool {
+	return s.connected
+}
+
+func (s *SSHSession) Reconnect() CliSession {
+	s.Close()
+	s.isSuccess(s.connect())
+	return s
+}
+
+func (s *SSHSession) Close() {
+	s.connected = false
+	if s.client != nil {
+		s.session.Close()
+		s.client.Close()
+		s.client, s.session = nil, nil
+	}
+}
+
+func (s *SSHSession) isSuccess(err error) bool {
+	if err != nil {
+		s.logger(fmt.Sprintf("%s", err))
+		s.Close()
+	}
+	return s.connected
+}
+
+//
+// sshClientConfig - return config with auth by key of -ssh-key and password (also keyboard-interactive),
+// host key is checked by -ssh-known-hosts, SSH is refused without it
+//
+func sshClientConfig(login, password string, timeout time.Duration) (*ssh.ClientConfig, error) {
+	// password of OLT should not be sent to host which key is not known
+	if *sshKnownHosts == "" {
+		return nil, fmt.Errorf("host key of OLT can not be checked, -ssh-known-hosts is not set")
+	}
+	callback, err := knownhosts.New(*sshKnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("can not load known hosts: %s", err)
+	}
+
+	config := &ssh.ClientConfig{
+		User:            login,
+		Timeout:         timeout,
+		HostKeyCallback: callback,
+	}
+
+	if *sshKey != "" {
+		key, err := ioutil.ReadFile(*sshKey)
+		if err != nil {
+			return nil, fmt.Errorf("can not read SSH key: %s", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("can not parse SSH key: %s", err)
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+
+	if password != "" {
+		config.Auth = append(config.Auth,
+			ssh.Password(password),
+			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = password
+				}
+				return answers, nil
+			}))
+	}
+	return config, nil
+}
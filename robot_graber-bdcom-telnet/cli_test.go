@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	cliTestLogin    = "admin"
+	cliTestPassword = "secret"
+	cliTestOnus     = "EPON0/1:1   fcfa.f711.2233  AN5506  authenticated  120  12  2021-03-04 10:11:12  2021-03-04 09:00:00  power-off  0.01:11:12\r\n" +
+		"EPON0/1:2   fcfa.f711.4455  AN5506  authenticated  340  31  2021-03-04 10:11:12  2021-03-04 09:00:00  wire-down  0.01:11:12\r\n"
+)
+
+//
+// cliTestServer - SSH server with CLI of BDCOM OLT: '>' - user mode, '#' - privileged mode
+//
+type cliTestServer struct {
+	port       int
+	knownHosts string // known_hosts file with key of server
+	clientKey  string // private key accepted by server
+
+	mu       sync.Mutex
+	sessions int
+}
+
+func newCliTestServer(t *testing.T) *cliTestServer {
+	dir := t.TempDir()
+	s := &cliTestServer{knownHosts: filepath.Join(dir, "known_hosts"), clientKey: filepath.Join(dir, "id_rsa")}
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPub, err := ssh.NewPublicKey(&clientKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(clientKey)}
+	if err = ioutil.WriteFile(s.clientKey, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == cliTestLogin && string(pass) == cliTestPassword {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == cliTestLogin && string(key.Marshal()) == string(clientPub.Marshal()) {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s.port = ln.Addr().(*net.TCPAddr).Port
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(ln.Addr().String())}, hostSigner.PublicKey())
+	if err = ioutil.WriteFile(s.knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+
+	*sshPort, *sshKey, *sshKnownHosts = s.port, "", s.knownHosts
+	return s
+}
+
+func (s *cliTestServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session")
+			continue
+		}
+		ch, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				req.Reply(req.Type == "pty-req" || req.Type == "shell", nil)
+			}
+		}()
+
+		s.mu.Lock()
+		s.sessions++
+		s.mu.Unlock()
+		go s.shell(ch)
+	}
+}
+
+func (s *cliTestServer) sessionCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions
+}
+
+func (s *cliTestServer) shell(ch ssh.Channel) {
+	defer ch.Close()
+	write := func(text string) { ch.Write([]byte(text)) }
+
+	write("\r\nWelcome to OLT\r\nOLT>")
+	privileged, enable := false, false
+	scanner := bufio.NewScanner(ch)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case enable:
+			enable = false
+			if privileged = line == cliTestPassword; !privileged {
+				write("\r\n% Bad password\r\nOLT>")
+				continue
+			}
+			write("\r\nOLT#")
+		case line == "enable":
+			enable = true
+			write("\r\nPassword:")
+		case line == "exit" && privileged:
+			privileged = false
+			write("\r\nOLT>")
+		case line == "exit":
+			return
+		case line == "show epon active-onu" && privileged:
+			write("\r\n" + cliTestOnus + "OLT#")
+		case line == "slow":
+			time.Sleep(2 * time.Second)
+			write("\r\nOLT#")
+		default:
+			write("\r\n% Unknown command.\r\nOLT" + map[bool]string{false: ">", true: "#"}[privileged])
+		}
+	}
+}
+
+func cliTestLogger(t *testing.T) func(string) {
+	return func(msg string) { t.Log(msg) }
+}
+
+func TestSSHRequiresKnownHosts(t *testing.T) {
+	newCliTestServer(t)
+	*sshKnownHosts = ""
+
+	if _, _, err := CliConnect("ssh", "127.0.0.1", cliTestLogin, cliTestPassword, time.Second, cliTestLogger(t)); err == nil {
+		t.Errorf("SSH session is opened without known hosts")
+	}
+}
+
+func TestSSHUnknownHostKey(t *testing.T) {
+	s := newCliTestServer(t)
+
+	// known_hosts has other key for address of server
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := ssh.NewPublicKey(other)
+	line := knownhosts.Line([]string{knownhosts.Normalize(net.JoinHostPort("127.0.0.1", strconv.Itoa(s.port)))}, otherKey)
+	if err := ioutil.WriteFile(s.knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := CliConnect("ssh", "127.0.0.1", cliTestLogin, cliTestPassword, time.Second, cliTestLogger(t)); err == nil {
+		t.Errorf("SSH session is opened to host with unknown key")
+	}
+}
+
+func TestSSHPasswordAuth(t *testing.T) {
+	newCliTestServer(t)
+
+	cli, addr, err := CliConnect("ssh", "127.0.0.1", cliTestLogin, cliTestPassword, 2*time.Second, cliTestLogger(t))
+	if err != nil {
+		t.Fatalf("connect to %s: %s", addr, err)
+	}
+	defer cli.Close()
+
+	if !cli.Expect(">").SendLine("enable").Expect("assword:", "#").SendLine(cliTestPassword).Expect("#").IsConnected() {
+		t.Fatal("can not enter privileged mode")
+	}
+
+	re := regexp.MustCompile(`(EPON\d+\/\d+:\d+)\s+([a-f\d\.]{14})`)
+	onus := cli.SendLine("show epon active-onu").ReadUntil('#').FindAllStringSubmatch(re)
+	if len(onus) != 2 || onus[0][1] != "EPON0/1:1" || onus[1][2] != "fcfa.f711.4455" {
+		t.Errorf("onus: %v", onus)
+	}
+	if macs := cli.FindAllString(regexp.MustCompile(`[a-f\d]{4}\.[a-f\d]{4}\.[a-f\d]{4}`)); len(macs) != 2 {
+		t.Errorf("macs: %v", macs)
+	}
+
+	// output of command is read till prompt, next command gets own output
+	if out := cli.SendLine("unknown").ReadUntil('#').FindAllString(re); len(out) != 0 {
+		t.Errorf("output of previous command is read again: %v", out)
+	}
+}
+
+func TestSSHBadPassword(t *testing.T) {
+	newCliTestServer(t)
+
+	if _, _, err := CliConnect("ssh", "127.0.0.1", cliTestLogin, "wrong", time.Second, cliTestLogger(t)); err == nil {
+		t.Errorf("SSH session is opened with wrong password")
+	}
+}
+
+func TestSSHKeyAuth(t *testing.T) {
+	s := newCliTestServer(t)
+	*sshKey = s.clientKey
+
+	cli, addr, err := CliConnect("ssh", "127.0.0.1", cliTestLogin, "", 2*time.Second, cliTestLogger(t))
+	if err != nil {
+		t.Fatalf("connect to %s: %s", addr, err)
+	}
+	defer cli.Close()
+
+	if !cli.Expect(">").IsConnected() {
+		t.Errorf("no prompt after auth by key")
+	}
+}
+
+func TestSSHTimeoutAndReconnect(t *testing.T) {
+	s := newCliTestServer(t)
+
+	cli, addr, err := CliConnect("ssh", "127.0.0.1", cliTestLogin, cliTestPassword, time.Second, cliTestLogger(t))
+	if err != nil {
+		t.Fatalf("connect to %s: %s", addr, err)
+	}
+	defer cli.Close()
+
+	// slow command closes session by timeout
+	if cli.Expect(">").SendLine("slow").ReadUntil('#').IsConnected() {
+		t.Fatal("session is alive after timeout")
+	}
+	if cli.SendLine("enable").IsConnected() {
+		t.Fatal("closed session accepts commands")
+	}
+
+	if !cli.Reconnect().Expect(">").IsConnected() {
+		t.Fatal("session is not reconnected")
+	}
+	if sessions := s.sessionCount(); sessions != 2 {
+		t.Errorf("sessions: %d, expected 2", sessions)
+	}
+	if !cli.SendLine("enable").Expect("assword:").SendLine(cliTestPassword).Expect("#").IsConnected() {
+		t.Errorf("reconnected session does not work")
+	}
+}
+
+func TestBdcomEponOverSSH(t *testing.T) {
+	newCliTestServer(t)
+	*telnetTimeout = 2
+
+	driver := NewBdcomEpon(&OltDevice{ip: "127.0.0.1", transport: "ssh", login: cliTestLogin, password: cliTestPassword})
+	defer driver.Close()
+
+	onus, err := driver.ListOnus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(onus) != 2 {
+		t.Fatalf("onus: %v", onus)
+	}
+	if onu := onus[1]; onu.Name != "EPON0/1:2" || onu.MAC != "FC:FA:F7:11:44:55" || onu.Distance != "340" ||
+		onu.RTT != "31" || onu.DeregReason != "wire-down" {
+		t.Errorf("onu: %+v", onu)
+	}
+}
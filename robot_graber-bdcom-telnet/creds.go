@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	h "github.com/a4lex/go-helpers"
+)
+
+//
+// Credentials - login profiles of devices are stored in DB table credentials, secrets (password,
+// community, SNMPv3 keys) are encrypted by AES-GCM with key from credentials_key of config.yml or
+// env ROBOTS_CREDENTIALS_KEY. Profile is bound to device (devices.credential_id, epon.credential_id)
+// or to group of devices (device_types.credential_id), profiles are reloaded every run, so password
+// can be rotated by update of DB row
+//
+
+const (
+	credentialsKeyEnv = "ROBOTS_CREDENTIALS_KEY"
+	credentialsPrefix = "aes:"
+
+	sqlGetCredentials = `SELECT id, name, login, password, community, snmp_auth_key, snmp_priv_key FROM credentials`
+)
+
+//
+// Credential struct for store decrypted login profile
+//
+type Credential struct {
+	ID          string
+	Name        string
+	Login       string
+	Password    string
+	Community   string
+	SnmpAuthKey string
+	SnmpPrivKey string
+}
+
+var (
+	credentialsAEAD cipher.AEAD
+
+	credentialsMu     sync.Mutex
+	credentialsByID   map[string]*Credential
+	credentialsByName map[string]*Credential
+)
+
+//
+// InitCredentials - init cipher by key from env or config, without key profiles can not be decrypted
+//
+func InitCredentials(key string) error {
+	if env := os.Getenv(credentialsKeyEnv); env != "" {
+		key = env
+	}
+	if key == "" {
+		return nil
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return err
+	}
+	credentialsAEAD, err = cipher.NewGCM(block)
+	return err
+}
+
+//
+// EncryptSecret - return secret encrypted for store in table credentials
+//
+func EncryptSecret(secret string) (string, error) {
+	if credentialsAEAD == nil {
+		return "", fmt.Errorf("credentials key is not set (credentials_key of config or env %s)", credentialsKeyEnv)
+	}
+	nonce := make([]byte, credentialsAEAD.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := credentialsAEAD.Seal(nonce, nonce, []byte(secret), nil)
+	return credentialsPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+//
+// DecryptSecret - return secret decrypted from table credentials, empty value is kept empty
+//
+func DecryptSecret(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(value, credentialsPrefix) {
+		return "", fmt.Errorf("value is not encrypted")
+	}
+	if credentialsAEAD == nil {
+		return "", fmt.Errorf("credentials key is not set (credentials_key of config or env %s)", credentialsKeyEnv)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, credentialsPrefix))
+	if err != nil {
+		return "", err
+	}
+	size := credentialsAEAD.NonceSize()
+	if len(sealed) < size {
+		return "", fmt.Errorf("value is too short")
+	}
+	secret, err := credentialsAEAD.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return "", fmt.Errorf("can not decrypt value, wrong key?")
+	}
+	return string(secret), nil
+}
+
+//
+// EncryptSecrets - print encrypted value for every line of input, used by -encrypt flag
+//
+func EncryptSecrets(in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		value, err := EncryptSecret(strings.TrimRight(scanner.Text(), "\r"))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, value)
+	}
+	return scanner.Err()
+}
+
+//
+// ResetCredentials - drop loaded profiles, they are loaded again by first use
+//
+func ResetCredentials() {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	credentialsByID, credentialsByName = nil, nil
+}
+
+//
+// GetCredential - return profile by id, nil if id is empty or profile is not found
+//
+func GetCredential(id string) *Credential {
+	if id == "" {
+		return nil
+	}
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	loadCredentials()
+	return credentialsByID[id]
+}
+
+//
+// GetCredentialByName - return profile by name, nil if name is empty or profile is not found
+//
+func GetCredentialByName(name string) *Credential {
+	if name == "" {
+		return nil
+	}
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	loadCredentials()
+	return credentialsByName[name]
+}
+
+//
+// loadCredentials - load and decrypt profiles, profile with broken secret is skipped
+//
+func loadCredentials() {
+	if credentialsByID != nil {
+		return
+	}
+	credentialsByID = make(map[string]*Credential)
+	credentialsByName = make(map[string]*Credential)
+
+	for _, row := range mysqli.DBSelectList(sqlGetCredentials) {
+		cred := &Credential{ID: row["id"], Name: row["name"], Login: row["login"]}
+		var err error
+		for _, field := range []struct {
+			name  string
+			value *string
+		}{
+			{"password", &cred.Password},
+			{"community", &cred.Community},
+			{"snmp_auth_key", &cred.SnmpAuthKey},
+			{"snmp_priv_key", &cred.SnmpPrivKey},
+		} {
+			if *field.value, err = DecryptSecret(row[field.name]); err != nil {
+				l.Printf(h.ERROR, "Credential %s: bad %s: %s", cred.Name, field.name, err)
+				break
+			}
+		}
+		if err != nil {
+			continue
+		}
+		credentialsByID[cred.ID] = cred
+		credentialsByName[cred.Name] = cred
+	}
+	l.Printf(h.DEBUG, "Loaded credentials: %d", len(credentialsByID))
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	h "github.com/a4lex/go-helpers"
+	"github.com/gosnmp/gosnmp"
+)
+
+//
+// Computed templates - value of template with snmp_templates.expr is calculated by expression
+// over values of device (or iface) instead of query, rate is applied to result as usual:
+//   [OID]       - value of OID, for iface templates OID is suffixed by ifIndex
+//   {path}      - value of other template of device type (its query and rate), e.g. {mem/total}
+//   sum[OID]    - sum of all rows of table column, avg, min, max and count are also supported
+//   + - * / ( ) - arithmetic, numbers (e.g. 1.5, 1e-5)
+// OID can be numeric or symbolic name of MIB, e.g. "([.1.3.6.1.4.1.9.9.48.1.1.1.5.1] -
+// [.1.3.6.1.4.1.9.9.48.1.1.1.6.1]) / sum[.1.3.6.1.4.1.9.9.48.1.1.1.5] * 100"
+//
+
+//
+// Expr struct for store compiled expression of template
+//
+type Expr struct {
+	text  string
+	root  exprFunc
+	gets  []exprGet // [OID] and {path} operands
+	walks []string  // columns of aggregate operands
+}
+
+type exprGet struct {
+	oid      string
+	template *OID // template of {path} operand for parse value, nil for [OID]
+}
+
+type exprFunc func(env *exprValues) (float64, error)
+
+type exprValues struct {
+	gets  []float64 // values of gets of expression by position
+	walks map[string][]float64
+}
+
+//
+// ExprEnv struct for evaluate expressions of one device, walked columns are shared by expressions
+//
+type ExprEnv struct {
+	con   *gosnmp.GoSNMP
+	walks map[string][]float64
+}
+
+//
+// CompileExprTemplates - compile expressions of templates of one device (or iface) type,
+// {path} operands are taken from the same list, templates with bad expressions are dropped
+//
+func CompileExprTemplates(templates []*OID) []*OID {
+	byPath := make(map[string]*OID, len(templates))
+	for _, template := range templates {
+		byPath[template.path] = template
+	}
+
+	result := templates[:0]
+	for _, template := range templates {
+		if template.exprText != "" {
+			expr, err := CompileExpr(template.exprText, byPath)
+			if err != nil {
+				l.Printf(h.ERROR, "Template %s: bad expr: %s", template.path, err)
+				continue
+			}
+			template.expr = expr
+		}
+		result = append(result, template)
+	}
+	return result
+}
+
+//
+// SplitExprTemplates - split templates to polled by query and computed by expression
+//
+func SplitExprTemplates(templates []*OID) (polled, computed []*OID) {
+	for _, template := range templates {
+		if template.expr != nil {
+			computed = append(computed, template)
+		} else {
+			polled = append(polled, template)
+		}
+	}
+	return polled, computed
+}
+
+//
+// CompileExpr - parse expression, templates are used for {path} operands
+//
+func CompileExpr(text string, templates map[string]*OID) (*Expr, error) {
+	p := &exprParser{text: text, templates: templates, expr: &Expr{text: text}}
+	root, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.text) {
+		return nil, fmt.Errorf("unexpected '%s' at %d", p.text[p.pos:], p.pos)
+	}
+	p.expr.root = root
+	return p.expr, nil
+}
+
+//
+// NewExprEnv - return env for evaluate expressions by SNMP connection of device
+//
+func NewExprEnv(con *gosnmp.GoSNMP) *ExprEnv {
+	return &ExprEnv{con: con, walks: make(map[string][]float64)}
+}
+
+//
+// Eval - fetch operands of expression and return its value, index is suffix of [OID] and {path}
+// operands (ifIndex for iface templates, empty for device), OIDs of operands found in replace
+// (by OID without leading dot) are replaced, e.g. 32-bit counters of iface by 64-bit ones
+//
+func (env *ExprEnv) Eval(expr *Expr, index string, replace map[string]string) (*big.Float, error) {
+	values := &exprValues{gets: make([]float64, len(expr.gets)), walks: env.walks}
+
+	oids := make([]string, len(expr.gets))
+	for i, get := range expr.gets {
+		oids[i] = get.oid
+		if oid, ok := replace[strings.Trim(get.oid, ".")]; ok {
+			oids[i] = oid
+		}
+		if index != "" {
+			oids[i] += "." + index
+		}
+	}
+	for from := 0; from < len(oids); from += env.con.MaxOids {
+		to := from + env.con.MaxOids
+		if to > len(oids) {
+			to = len(oids)
+		}
+		result, err := env.con.Get(oids[from:to])
+		if err != nil {
+			return nil, err
+		}
+		for i, pdu := range result.Variables {
+			if from+i >= to {
+				break
+			}
+			val := new(big.Float)
+			if err := ParseSNMPResult(&pdu, expr.gets[from+i].template, val); err != nil {
+				return nil, err
+			}
+			values.gets[from+i], _ = val.Float64()
+		}
+	}
+
+	for _, column := range expr.walks {
+		if _, ok := env.walks[column]; ok {
+			continue
+		}
+		rows, err := WalkTable(env.con, []string{column})
+		if err != nil {
+			return nil, err
+		}
+		env.walks[column] = make([]float64, 0, len(rows))
+		for _, row := range rows {
+			val := new(big.Float)
+			if row.Values[0] == nil || ParseSNMPResult(row.Values[0], nil, val) != nil {
+				continue
+			}
+			f, _ := val.Float64()
+			env.walks[column] = append(env.walks[column], f)
+		}
+	}
+
+	val, err := expr.root(values)
+	if err != nil {
+		return nil, err
+	}
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		return nil, fmt.Errorf("value of expr is not number: %s", expr.text)
+	}
+	return big.NewFloat(val), nil
+}
+
+type exprParser struct {
+	text      string
+	pos       int
+	templates map[string]*OID
+	expr      *Expr
+	depth     int // depth of {path} operands, guards from loops
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.text) && strings.IndexByte(" \t\r\n", p.text[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *exprParser) accept(c byte) bool {
+	if p.skipSpace(); p.pos < len(p.text) && p.text[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+//
+// parseSum - sum := product { (+|-) product }
+//
+func (p *exprParser) parseSum() (exprFunc, error) {
+	left, err := p.parseProduct()
+	for err == nil {
+		var op byte
+		switch {
+		case p.accept('+'):
+			op = '+'
+		case p.accept('-'):
+			op = '-'
+		default:
+			return left, nil
+		}
+		var right exprFunc
+		if right, err = p.parseProduct(); err == nil {
+			left = exprBinary(op, left, right)
+		}
+	}
+	return nil, err
+}
+
+//
+// parseProduct - product := unary { (*|/) unary }
+//
+func (p *exprParser) parseProduct() (exprFunc, error) {
+	left, err := p.parseUnary()
+	for err == nil {
+		var op byte
+		switch {
+		case p.accept('*'):
+			op = '*'
+		case p.accept('/'):
+			op = '/'
+		default:
+			return left, nil
+		}
+		var right exprFunc
+		if right, err = p.parseUnary(); err == nil {
+			left = exprBinary(op, left, right)
+		}
+	}
+	return nil, err
+}
+
+//
+// parseUnary - unary := -unary | number | (sum) | [OID] | func[OID] | {path}
+//
+func (p *exprParser) parseUnary() (exprFunc, error) {
+	switch {
+	case p.accept('-'):
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *exprValues) (float64, error) {
+			val, err := operand(env)
+			return -val, err
+		}, nil
+
+	case p.accept('('):
+		operand, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(')') {
+			return nil, fmt.Errorf("expected ')' at %d", p.pos)
+		}
+		return operand, nil
+
+	case p.accept('['):
+		oid, err := p.parseOID()
+		if err != nil {
+			return nil, err
+		}
+		i := len(p.expr.gets)
+		p.expr.gets = append(p.expr.gets, exprGet{oid: oid})
+		return func(env *exprValues) (float64, error) {
+			return env.gets[i], nil
+		}, nil
+
+	case p.accept('{'):
+		end := strings.IndexByte(p.text[p.pos:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("expected '}' at %d", p.pos)
+		}
+		path := strings.TrimSpace(p.text[p.pos : p.pos+end])
+		p.pos += end + 1
+		return p.parseTemplate(path)
+	}
+
+	start := p.pos
+	if p.pos < len(p.text) && (isExprDigit(p.text[p.pos]) || p.text[p.pos] == '.') {
+		return p.parseNumber()
+	}
+	for p.pos < len(p.text) && isMibIdentChar(p.text[p.pos]) {
+		p.pos++
+	}
+	word := p.text[start:p.pos]
+	if word == "" {
+		return nil, fmt.Errorf("expected operand at %d", p.pos)
+	}
+
+	aggregate, ok := exprAggregates[word]
+	if !ok || !p.accept('[') {
+		return nil, fmt.Errorf("unknown operand '%s' at %d", word, start)
+	}
+	column, err := p.parseOID()
+	if err != nil {
+		return nil, err
+	}
+	p.expr.walks = append(p.expr.walks, column)
+	return func(env *exprValues) (float64, error) {
+		return aggregate(env.walks[column])
+	}, nil
+}
+
+//
+// parseNumber - number := digits[.digits][(e|E)[+|-]digits]
+//
+func (p *exprParser) parseNumber() (exprFunc, error) {
+	start := p.pos
+	for p.pos < len(p.text) && (isExprDigit(p.text[p.pos]) || p.text[p.pos] == '.') {
+		p.pos++
+	}
+	if p.pos < len(p.text) && (p.text[p.pos] == 'e' || p.text[p.pos] == 'E') {
+		exp := p.pos + 1
+		if exp < len(p.text) && (p.text[exp] == '+' || p.text[exp] == '-') {
+			exp++
+		}
+		if exp < len(p.text) && isExprDigit(p.text[exp]) {
+			for p.pos = exp; p.pos < len(p.text) && isExprDigit(p.text[p.pos]); p.pos++ {
+			}
+		}
+	}
+
+	val, err := strconv.ParseFloat(p.text[start:p.pos], 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad number '%s' at %d", p.text[start:p.pos], start)
+	}
+	return func(env *exprValues) (float64, error) {
+		return val, nil
+	}, nil
+}
+
+//
+// parseOID - parse OID of operand till ']', symbolic name is resolved by MIB
+//
+func (p *exprParser) parseOID() (string, error) {
+	end := strings.IndexByte(p.text[p.pos:], ']')
+	if end < 0 {
+		return "", fmt.Errorf("expected ']' at %d", p.pos)
+	}
+	query := strings.TrimSpace(p.text[p.pos : p.pos+end])
+	p.pos += end + 1
+
+	oid, _, err := ResolveOID(query)
+	if err != nil {
+		return "", err
+	}
+	if oid == "" {
+		return "", fmt.Errorf("empty OID at %d", p.pos)
+	}
+	return "." + strings.Trim(oid, "."), nil
+}
+
+//
+// parseTemplate - operand of other template is its query (or expression) multiplied by rate
+//
+func (p *exprParser) parseTemplate(path string) (exprFunc, error) {
+	template, ok := p.templates[path]
+	if !ok {
+		return nil, fmt.Errorf("unknown template {%s}", path)
+	}
+	if p.depth > 8 {
+		return nil, fmt.Errorf("too deep templates {%s}", path)
+	}
+
+	var operand exprFunc
+	if template.exprText != "" {
+		sub := &exprParser{text: template.exprText, templates: p.templates, expr: p.expr, depth: p.depth + 1}
+		root, err := sub.parseSum()
+		if err != nil {
+			return nil, fmt.Errorf("template {%s}: %s", path, err)
+		}
+		operand = root
+	} else {
+		i := len(p.expr.gets)
+		p.expr.gets = append(p.expr.gets, exprGet{oid: "." + strings.Trim(template.query, "."), template: template})
+		operand = func(env *exprValues) (float64, error) {
+			return env.gets[i], nil
+		}
+	}
+
+	rate := 1.0
+	if template.rate != nil {
+		rate, _ = template.rate.Float64()
+	}
+	return func(env *exprValues) (float64, error) {
+		val, err := operand(env)
+		return val * rate, err
+	}, nil
+}
+
+func isExprDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func exprBinary(op byte, left, right exprFunc) exprFunc {
+	return func(env *exprValues) (float64, error) {
+		a, err := left(env)
+		if err != nil {
+			return 0, err
+		}
+		b, err := right(env)
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case '+':
+			return a + b, nil
+		case '-':
+			return a - b, nil
+		case '*':
+			return a * b, nil
+		}
+		if b == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return a / b, nil
+	}
+}
+
+var exprAggregates = map[string]func(values []float64) (float64, error){
+	"sum": func(values []float64) (float64, error) {
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum, nil
+	},
+	"avg": func(values []float64) (float64, error) {
+		if len(values) == 0 {
+			return 0, fmt.Errorf("avg of empty column")
+		}
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values)), nil
+	},
+	"min": func(values []float64) (float64, error) {
+		if len(values) == 0 {
+			return 0, fmt.Errorf("min of empty column")
+		}
+		min := values[0]
+		for _, v := range values {
+			min = math.Min(min, v)
+		}
+		return min, nil
+	},
+	"max": func(values []float64) (float64, error) {
+		if len(values) == 0 {
+			return 0, fmt.Errorf("max of empty column")
+		}
+		max := values[0]
+		for _, v := range values {
+			max = math.Max(max, v)
+		}
+		return max, nil
+	},
+	"count": func(values []float64) (float64, error) {
+		return float64(len(values)), nil
+	},
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"math/big"
+	"regexp"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+func TestCompileExpr(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		val  float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 2 - 3", 5},
+		{"8 / 4 / 2", 1},
+		{"-2 * -3", 6},
+		{"- (1 + 2) * 2", -6},
+		{"2 - -1", 3},
+		{"1e-5 * 1e5", 1},
+		{"2.5E+2 + .5", 250.5},
+	} {
+		expr, err := CompileExpr(c.text, nil)
+		if err != nil {
+			t.Errorf("%s: %s", c.text, err)
+			continue
+		}
+		if val, err := expr.root(&exprValues{}); err != nil || val != c.val {
+			t.Errorf("%s = %g (%v), expected %g", c.text, val, err, c.val)
+		}
+	}
+
+	for _, text := range []string{
+		"", "1 +", "(1", "1 2", "1e", "1..2", "[.1.3", "{mem", "{mem/total}", "avg", "foo[.1.3]", "*2",
+	} {
+		if _, err := CompileExpr(text, nil); err == nil {
+			t.Errorf("bad expr %q is compiled", text)
+		}
+	}
+
+	expr, _ := CompileExpr("1 / (2 - 2)", nil)
+	if _, err := expr.root(&exprValues{}); err == nil {
+		t.Errorf("division by zero has no error")
+	}
+}
+
+func TestCompileExprTemplates(t *testing.T) {
+	templates := CompileExprTemplates([]*OID{
+		{path: "mem/total", query: ".1.3.6.1.4.1.1.1"},
+		{path: "mem/used", exprText: "{mem/total} - {mem/free}"},
+		{path: "mem/free", query: "1.3.6.1.4.1.1.2"},
+		{path: "mem/loop", exprText: "{mem/loop} + 1"},
+		{path: "mem/bad", exprText: "{mem/none}"},
+	})
+	if len(templates) != 3 || templates[1].expr == nil {
+		t.Fatalf("templates: %v", templates)
+	}
+
+	// operands of {path} are collected from nested templates
+	gets := templates[1].expr.gets
+	if len(gets) != 2 || gets[0].oid != ".1.3.6.1.4.1.1.1" || gets[1].oid != ".1.3.6.1.4.1.1.2" || gets[1].template != templates[2] {
+		t.Errorf("gets: %v", gets)
+	}
+}
+
+func TestExprEval(t *testing.T) {
+	a := &snmpTestAgent{version: gosnmp.Version2c, values: map[string]interface{}{
+		".1.3.6.1.4.1.1.1":          1000,
+		".1.3.6.1.4.1.1.2":          "free 250 kB",
+		".1.3.6.1.2.1.2.2.1.10.3":   5,
+		".1.3.6.1.2.1.31.1.1.1.6.3": 100,
+		".1.3.6.1.4.1.2.1.1":        1,
+		".1.3.6.1.4.1.2.1.2":        2,
+		".1.3.6.1.4.1.2.1.3":        6,
+	}}
+	for oid := range a.values {
+		a.oids = append(a.oids, oid)
+	}
+	con := a.start(t)
+	env := NewExprEnv(con)
+
+	templates := CompileExprTemplates([]*OID{
+		{path: "mem/total", query: ".1.3.6.1.4.1.1.1", rate: big.NewFloat(1)},
+		{path: "mem/free", query: ".1.3.6.1.4.1.1.2", rate: big.NewFloat(2), extract: regexp.MustCompile(`(\d+) kB`)},
+		{path: "mem/used", exprText: "{mem/total} - {mem/free}", rate: big.NewFloat(1)},
+		{path: "mem/percent", exprText: "{mem/used} / {mem/total} * 100", rate: big.NewFloat(1)},
+	})
+	if val, err := env.Eval(templates[3].expr, "", nil); err != nil || val.String() != "50" {
+		t.Errorf("mem/percent = %v (%v), expected 50", val, err)
+	}
+
+	for _, c := range []struct {
+		text  string
+		index string
+		hc    bool
+		val   string
+	}{
+		{"sum[.1.3.6.1.4.1.2.1] + count[.1.3.6.1.4.1.2.1] * 10", "", false, "39"},
+		{"avg[.1.3.6.1.4.1.2.1] - min[.1.3.6.1.4.1.2.1] + max[.1.3.6.1.4.1.2.1]", "", false, "8"},
+		{"[.1.3.6.1.2.1.2.2.1.10] * 8", "3", false, "40"},
+		{"[.1.3.6.1.2.1.2.2.1.10] * 8", "3", true, "800"},
+	} {
+		expr, err := CompileExpr(c.text, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", c.text, err)
+		}
+		var replace map[string]string
+		if c.hc {
+			replace = map[string]string{"1.3.6.1.2.1.2.2.1.10": ".1.3.6.1.2.1.31.1.1.1.6"}
+		}
+		if val, err := env.Eval(expr, c.index, replace); err != nil || val.String() != c.val {
+			t.Errorf("%s (index %s, hc %v) = %v (%v), expected %s", c.text, c.index, c.hc, val, err, c.val)
+		}
+	}
+
+	// value of operand is unknown
+	expr, _ := CompileExpr("[.1.3.6.1.4.1.1.9] + 1", nil)
+	if val, err := env.Eval(expr, "", nil); err == nil {
+		t.Errorf("expr without value of operand = %v", val)
+	}
+}
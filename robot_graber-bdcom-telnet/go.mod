@@ -5,5 +5,5 @@ go 1.16
 require (
 	github.com/a4lex/go-helpers v0.0.7
 	github.com/gosnmp/gosnmp v1.34.0
-	github.com/ziutek/rrd v0.0.3
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
 )
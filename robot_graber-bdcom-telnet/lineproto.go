@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Text sinks - InfluxDB line protocol and Graphite plaintext protocol,
+// values are buffered and written to file, UDP/TCP socket or HTTP endpoint
+//
+
+const (
+	lineMaxUDP     = 1400
+	lineMaxStream  = 64 * 1024
+	lineMaxBacklog = 16 * 1024 * 1024 // lines kept while output is down
+	lineTimeout    = 10 * time.Second
+)
+
+//
+// LineSink buffer formatted lines of values and write them to output
+//
+type LineSink struct {
+	mu     sync.Mutex
+	output *url.URL
+	format func(s *Series, t time.Time, val float64) string
+	buf    bytes.Buffer
+	max    int
+	failed bool // last write is failed, lines are kept till next Flush
+	conn   net.Conn
+	file   *os.File
+}
+
+//
+// NewInfluxSink - return sink for InfluxDB line protocol:
+// <prefix>,shared=..,name=..,object_id=..,device_id=..,iface_id=..,device_type_id=.. value=<val> <unix ns>
+//
+func NewInfluxSink(c SinkConfig) (MetricSink, error) {
+	if c.Prefix == "" {
+		c.Prefix = "snmp"
+	}
+	measurement := influxEscape(c.Prefix, false)
+
+	return newLineSink(c, func(s *Series, t time.Time, val float64) string {
+		shared, name := splitPath(s.Path)
+		line := measurement + ",shared=" + influxEscape(shared, true) + ",name=" + influxEscape(name, true) +
+			",object_id=" + influxEscape(s.ObjectID, true)
+		for _, tag := range [][2]string{{"device_id", s.DeviceID}, {"iface_id", s.IfaceID}, {"device_type_id", s.DeviceType}} {
+			if tag[1] != "" {
+				line += "," + tag[0] + "=" + influxEscape(tag[1], true)
+			}
+		}
+		return fmt.Sprintf("%s value=%s %d\n", line, strconv.FormatFloat(val, 'g', -1, 64), t.UnixNano())
+	})
+}
+
+//
+// NewGraphiteSink - return sink for Graphite plaintext protocol with tags:
+// <prefix>.<shared>.<name>;object_id=..;device_id=..;iface_id=..;device_type_id=.. <val> <unix sec>
+//
+func NewGraphiteSink(c SinkConfig) (MetricSink, error) {
+	if c.Prefix == "" {
+		c.Prefix = "snmp"
+	}
+
+	return newLineSink(c, func(s *Series, t time.Time, val float64) string {
+		shared, name := splitPath(s.Path)
+		line := c.Prefix + "." + graphiteEscape(shared) + "." + graphiteEscape(name) +
+			";object_id=" + graphiteEscape(s.ObjectID)
+		for _, tag := range [][2]string{{"device_id", s.DeviceID}, {"iface_id", s.IfaceID}, {"device_type_id", s.DeviceType}} {
+			if tag[1] != "" {
+				line += ";" + tag[0] + "=" + graphiteEscape(tag[1])
+			}
+		}
+		return fmt.Sprintf("%s %s %d\n", line, strconv.FormatFloat(val, 'g', -1, 64), t.Unix())
+	})
+}
+
+func newLineSink(c SinkConfig, format func(s *Series, t time.Time, val float64) string) (MetricSink, error) {
+	output, err := url.Parse(c.Output)
+	if err != nil {
+		return nil, fmt.Errorf("bad output %s: %s", c.Output, err)
+	}
+
+	sink := &LineSink{output: output, format: format, max: lineMaxStream}
+	switch output.Scheme {
+	case "file":
+		sink.file, err = os.OpenFile(output.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	case "udp":
+		sink.max = lineMaxUDP
+		sink.conn, err = net.Dial("udp", output.Host)
+	case "tcp":
+		sink.conn, err = net.DialTimeout("tcp", output.Host, lineTimeout)
+	case "http", "https":
+	default:
+		err = fmt.Errorf("unsupported output: %s", c.Output)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return sink, nil
+}
+
+//
+// Store - format value and write buffer if it is full
+//
+func (ls *LineSink) Store(s *Series, t time.Time, val *big.Float) error {
+	// line protocols have no unknown value, point is skipped
+	if val == nil {
+		return nil
+	}
+	value, _ := val.Float64()
+	line := ls.format(s, t, value)
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	// output which is down is not retried by every value, only by Flush at the end of run
+	var err error
+	if ls.buf.Len() > 0 && ls.buf.Len()+len(line) > ls.max && !ls.failed {
+		err = ls.flush()
+	}
+	ls.buf.WriteString(line)
+	if ls.failed {
+		if dropped := ls.trim(); dropped > 0 && err == nil {
+			err = fmt.Errorf("output %s is down, %d bytes of oldest lines are dropped", ls.output.Host, dropped)
+		}
+	}
+	return err
+}
+
+//
+// Flush - write all buffered lines to output
+//
+func (ls *LineSink) Flush() error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.flush()
+}
+
+//
+// Close - flush buffered lines and close output
+//
+func (ls *LineSink) Close() error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	err := ls.flush()
+	if ls.conn != nil {
+		ls.conn.Close()
+		ls.conn = nil
+	}
+	if ls.file != nil {
+		ls.file.Close()
+		ls.file = nil
+	}
+	return err
+}
+
+//
+// flush - write buffered lines, they are kept (up to lineMaxBacklog) if write is failed,
+// lines of UDP are dropped, it has no delivery anyway
+//
+func (ls *LineSink) flush() (err error) {
+	if ls.buf.Len() == 0 {
+		return nil
+	}
+	defer func() {
+		if ls.failed = err != nil && ls.output.Scheme != "udp"; !ls.failed {
+			ls.buf.Reset()
+		} else if dropped := ls.trim(); dropped > 0 {
+			err = fmt.Errorf("%s, %d bytes of oldest lines are dropped", err, dropped)
+		}
+	}()
+
+	switch ls.output.Scheme {
+	case "file":
+		_, err = ls.file.Write(ls.buf.Bytes())
+	case "udp":
+		_, err = ls.conn.Write(ls.buf.Bytes())
+	case "tcp":
+		// reconnect once, if connection was closed by remote side
+		for attempt := 0; attempt < 2; attempt++ {
+			if ls.conn == nil {
+				if ls.conn, err = net.DialTimeout("tcp", ls.output.Host, lineTimeout); err != nil {
+					return err
+				}
+			}
+			ls.conn.SetWriteDeadline(time.Now().Add(lineTimeout))
+			if _, err = ls.conn.Write(ls.buf.Bytes()); err == nil {
+				break
+			}
+			ls.conn.Close()
+			ls.conn = nil
+		}
+	case "http", "https":
+		client := http.Client{Timeout: lineTimeout}
+		var resp *http.Response
+		if resp, err = client.Post(ls.output.String(), "text/plain; charset=utf-8", bytes.NewReader(ls.buf.Bytes())); err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			err = fmt.Errorf("%s responce status: %s", ls.output.Host, resp.Status)
+		}
+	}
+
+	return err
+}
+
+//
+// trim - drop oldest lines over lineMaxBacklog, return count of dropped bytes
+//
+func (ls *LineSink) trim() int {
+	data := ls.buf.Bytes()
+	if len(data) <= lineMaxBacklog {
+		return 0
+	}
+	cut := len(data) - lineMaxBacklog
+	if i := bytes.IndexByte(data[cut:], '\n'); i >= 0 {
+		cut += i + 1
+	}
+	ls.buf.Next(cut)
+	return cut
+}
+
+//
+// splitPath - split template path to shared and name
+//
+func splitPath(path string) (string, string) {
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return "", path
+}
+
+func influxEscape(s string, tag bool) string {
+	if s == "" {
+		return "none"
+	}
+	if tag {
+		return strings.NewReplacer(`,`, `\,`, ` `, `\ `, `=`, `\=`).Replace(s)
+	}
+	return strings.NewReplacer(`,`, `\,`, ` `, `\ `).Replace(s)
+}
+
+func graphiteEscape(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return strings.NewReplacer(` `, `_`, `.`, `_`, `;`, `_`, `=`, `_`, `/`, `_`).Replace(s)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLineSinkFormat(t *testing.T) {
+	var lines []string
+	for _, factory := range []func(SinkConfig) (MetricSink, error){NewInfluxSink, NewGraphiteSink} {
+		sink, err := factory(SinkConfig{Output: "file:///dev/null"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ls := sink.(*LineSink)
+		lines = append(lines, ls.format(&Series{Path: "iface/in octets", ObjectID: "10", DeviceID: "1"}, time.Unix(1600000000, 0), 0.25))
+		ls.Close()
+	}
+
+	if lines[0] != "snmp,shared=iface,name=in\\ octets,object_id=10,device_id=1 value=0.25 1600000000000000000\n" {
+		t.Errorf("influx: %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], " 0.25 1600000000\n") || !strings.Contains(lines[1], "in_octets") {
+		t.Errorf("graphite: %q", lines[1])
+	}
+}
+
+func TestLineSinkKeepLinesWhileDown(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	down := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(data))
+	}))
+	defer srv.Close()
+
+	sink, err := NewInfluxSink(SinkConfig{Output: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := &Series{Path: "device/cpu", ObjectID: "1"}
+
+	sink.Store(series, time.Unix(1600000000, 0), big.NewFloat(1))
+	if err = sink.Flush(); err == nil {
+		t.Fatal("flush to failed output has no error")
+	}
+
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	sink.Store(series, time.Unix(1600000300, 0), big.NewFloat(2))
+	if err = sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bodies) != 1 || strings.Count(bodies[0], "\n") != 2 ||
+		!strings.Contains(bodies[0], "value=1 ") || !strings.Contains(bodies[0], "value=2 ") {
+		t.Errorf("bodies: %q", bodies)
+	}
+}
+
+func TestLineSinkBacklog(t *testing.T) {
+	ls := &LineSink{failed: true}
+	line := strings.Repeat("x", 1023) + "\n"
+	for ls.buf.Len() < lineMaxBacklog+10*len(line) {
+		ls.buf.WriteString(line)
+	}
+	ls.buf.WriteString("last\n")
+
+	if dropped := ls.trim(); dropped%len(line) != 0 || dropped == 0 {
+		t.Errorf("dropped %d bytes, lines are not dropped whole", dropped)
+	}
+	if ls.buf.Len() > lineMaxBacklog || !strings.HasSuffix(ls.buf.String(), "\nlast\n") {
+		t.Errorf("backlog %d bytes", ls.buf.Len())
+	}
+}
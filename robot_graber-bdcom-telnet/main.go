@@ -3,18 +3,36 @@ package main
 import (
 	"flag"
 	"fmt"
+	"math"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	h "github.com/a4lex/go-helpers"
+	"gopkg.in/yaml.v2"
 )
 
+//
+// Config - struct for config store, extends database config of helpers
+//
+type Config struct {
+	h.Config  `yaml:",inline"`
+	Sinks     []SinkConfig     `yaml:"sinks"`
+	Notifiers []NotifierConfig `yaml:"notifiers"`
+
+	// key of encrypted credentials, env ROBOTS_CREDENTIALS_KEY overrides it
+	CredentialsKey string `yaml:"credentials_key"`
+}
+
 var (
 	l      h.MyLogger
 	mysqli h.MySQL
-	cfg    h.Config
+	cfg    Config
+	sinks  MetricSinks
+
+	notifiers *Notifiers
 
 	timeUpdRRD time.Time
 
@@ -24,14 +42,23 @@ var (
 
 	dirRRD      = flag.String("dir-rrd", "/tmp/rrd", "Path to store RRD files")
 	threadCount = flag.Int("thread", 1, "Thread count for processing")
+
+	daemon     = flag.Bool("daemon", false, "Run as daemon, repeat processing on own schedule")
+	daemonStep = flag.Uint("daemon-step", 0, "Interval between runs in daemon mode, sec (default - min step of templates or 300)")
+
+	encrypt = flag.Bool("encrypt", false, "Encrypt secrets read from stdin (one per line) for table credentials and exit")
+
+	// stop is closed on SIGINT/SIGTERM, robots should stop pick new devices
+	stop = make(chan struct{})
+
+	// cycleStep min step of templates loaded by last run, it is read by exporter and threads
+	cycleStep   uint
+	cycleStepMu sync.Mutex
 )
 
 func main() {
 	flag.Parse()
 
-	finish := make(chan os.Signal, 1)
-	signal.Notify(finish, syscall.SIGINT, syscall.SIGTERM)
-
 	//
 	// Init logs
 	//
@@ -45,14 +72,60 @@ func main() {
 	l = h.InitLog(f, *logVerbose)
 	l.Printf(h.FUNC, "START")
 
+	//
+	// Graceful stop: first signal - finish current run, second - exit immediately
+	//
+
+	finish := make(chan os.Signal, 1)
+	signal.Notify(finish, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-finish
+		l.Printf(h.INFO, "Got signal %s, wait for finish current run", sig)
+		close(stop)
+		sig = <-finish
+		l.Printf(h.FATAL, "Got signal %s, exit immediately", sig)
+	}()
+
 	//
 	// Load config vars
 	//
 
-	if err = h.LoadConfig(*configPath, &cfg); err != nil {
+	if err = LoadConfig(*configPath, &cfg); err != nil {
 		panic(fmt.Sprintf("can not init config: %v", err))
 	}
 
+	//
+	// Init cipher of credentials, -encrypt only prints encrypted secrets
+	//
+
+	if err = InitCredentials(cfg.CredentialsKey); err != nil {
+		panic(fmt.Sprintf("can not init credentials: %v", err))
+	}
+	if *encrypt {
+		if err = EncryptSecrets(os.Stdin, os.Stdout); err != nil {
+			panic(fmt.Sprintf("can not encrypt secret: %v", err))
+		}
+		return
+	}
+
+	//
+	// Init sinks for fetched values
+	//
+
+	if sinks, err = InitSinks(cfg.Sinks); err != nil {
+		panic(fmt.Sprintf("can not init sinks: %v", err))
+	}
+	defer sinks.Close()
+
+	//
+	// Init notifiers, queued messages are sent before exit
+	//
+
+	if notifiers, err = InitNotifiers(cfg.Notifiers); err != nil {
+		panic(fmt.Sprintf("can not init notifiers: %v", err))
+	}
+	defer notifiers.Close()
+
 	//
 	// Init MySQL connection
 	//
@@ -62,11 +135,108 @@ func main() {
 		panic(fmt.Sprintf("failed connect to DB: %v", err))
 	}
 
-	process()
+	//
+	// Main Loop: run once, or repeat it on schedule in daemon mode
+	//
+
+	for {
+		ResetCycleStep()
+		ResetCredentials()
+		process()
+
+		if err = sinks.Flush(); err != nil {
+			l.Printf(h.ERROR, "Can not flush sinks: %s", err)
+		}
+
+		if !*daemon || !waitNextRun() {
+			break
+		}
+	}
 
 	l.Printf(h.FUNC, "END")
 }
 
+//
+// isStopping - return true if robot got signal for stop
+//
+func isStopping() bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+//
+// UpdateCycleStep - take into account step of loaded template for daemon schedule
+//
+func UpdateCycleStep(step uint) {
+	cycleStepMu.Lock()
+	defer cycleStepMu.Unlock()
+
+	if step > 0 && (cycleStep == 0 || step < cycleStep) {
+		cycleStep = step
+	}
+}
+
+//
+// ResetCycleStep - forget steps of templates before new run
+//
+func ResetCycleStep() {
+	cycleStepMu.Lock()
+	cycleStep = 0
+	cycleStepMu.Unlock()
+}
+
+//
+// CycleStep - return interval between runs in daemon mode
+//
+func CycleStep() time.Duration {
+	cycleStepMu.Lock()
+	defer cycleStepMu.Unlock()
+
+	switch {
+	case *daemonStep > 0:
+		return time.Duration(*daemonStep) * time.Second
+	case cycleStep > 0:
+		return time.Duration(cycleStep) * time.Second
+	}
+	return 300 * time.Second
+}
+
+//
+// waitNextRun - sleep till next run aligned to step, return false if robot should stop
+//
+func waitNextRun() bool {
+	step := CycleStep()
+	next := time.Now().Truncate(step).Add(step)
+	l.Printf(h.DEBUG, "Next run at: %s", next.Format("2006-01-02 15:04:05"))
+
+	select {
+	case <-stop:
+		return false
+	case <-time.After(time.Until(next)):
+		return true
+	}
+}
+
+//
+// LoadConfig - Load configuration from file
+//
+func LoadConfig(config string, cfg *Config) error {
+	if c, err := os.Open(config); err == nil {
+		defer c.Close()
+		decoder := yaml.NewDecoder(c)
+		if err = decoder.Decode(cfg); err != nil {
+			return fmt.Errorf("error parsing config file: %v", err)
+		}
+	} else {
+		return fmt.Errorf("error opening config file: %v", err)
+	}
+	return nil
+}
+
 func isFlagPassed(name string) (found bool) {
 	flag.Visit(func(f *flag.Flag) {
 		if f.Name == name {
@@ -79,60 +249,30 @@ func isFlagPassed(name string) (found bool) {
 //
 // RRDCreate - create file of RRD DB
 //
-func RRDCreate(dbfile, counterType string, min, max int, step uint) (string, error) {
+func RRDCreate(dbfile string, start time.Time, counterType string, min, max int, step uint) error {
+
+	// min >= max means that template do not limit values
+	ds := RRDDataSource{Name: "val", Type: counterType, Heartbeat: step * 2, Min: float64(min), Max: float64(max)}
+	if min >= max {
+		ds.Min, ds.Max = math.NaN(), math.NaN()
+	}
 
-	return "nil", nil
+	if err := RRDCreateFile(dbfile, start, step, []RRDDataSource{ds}, RRDDefaultArchives()); err != nil {
+		l.Printf(h.ERROR, "Can not create RRD DB: %s, counterType: %s, min: %d, max: %d", dbfile, counterType, min, max)
+		return err
+	}
+	l.Printf(h.DEBUG, "Create RRD DB: %s, counterType: %s, min: %d, max: %d", dbfile, counterType, min, max)
+	return nil
 }
 
 //
 // RRDUpdate - update RRD DB file with given value and time
 //
 func RRDUpdate(dbfile string, time time.Time, val string) error {
+	if err := RRDUpdateFile(dbfile, time, val); err != nil {
+		l.Printf(h.DEBUG, "Update is failed RRD DB: %s, time: %s, val: %s, error: %s", dbfile, time.Format("2006-01-02 15:04:05"), val, err)
+		return err
+	}
+	l.Printf(h.DEBUG, "Update RRD DB: %s, time: %s, val: %s", dbfile, time.Format("2006-01-02 15:04:05"), val)
 	return nil
 }
-
-// //
-// // RRDCreate - create file of RRD DB
-// //
-// func RRDCreate(dbfile, counterType string, min, max int, step uint) (*rrd.Creator, error) {
-
-// 	c := rrd.NewCreator(dbfile, time.Now(), step)
-// 	c.DS("val", counterType, step*2, min, max)
-// 	c.RRA("AVERAGE", 0.5, 1, 288)
-// 	c.RRA("LAST", 0.5, 1, 288)
-// 	c.RRA("MIN", 0.5, 1, 288)
-// 	c.RRA("MAX", 0.5, 1, 288)
-// 	c.RRA("AVERAGE", 0.5, 7, 288)
-// 	c.RRA("LAST", 0.5, 7, 288)
-// 	c.RRA("MIN", 0.5, 7, 288)
-// 	c.RRA("MAX", 0.5, 7, 288)
-// 	c.RRA("AVERAGE", 0.5, 30, 288)
-// 	c.RRA("LAST", 0.5, 30, 288)
-// 	c.RRA("MIN", 0.5, 30, 288)
-// 	c.RRA("MAX", 0.5, 30, 288)
-// 	c.RRA("AVERAGE", 0.5, 365, 288)
-// 	c.RRA("LAST", 0.5, 365, 288)
-// 	c.RRA("MIN", 0.5, 365, 288)
-// 	c.RRA("MAX", 0.5, 365, 288)
-
-// 	if err := c.Create(true); err != nil {
-// 		l.Printf(h.ERROR, "Can not create RRD DB: %s, counterType: %s, min: %d, max: %d", dbfile, counterType, min, max)
-// 		return nil, err
-// 	} else {
-// 		l.Printf(h.DEBUG, "Create RRD DB: %s, counterType: %s, min: %d, max: %d", dbfile, counterType, min, max)
-// 		return c, nil
-// 	}
-// }
-
-// //
-// // RRDUpdate - update RRD DB file with given value and time
-// //
-// func RRDUpdate(dbfile string, time time.Time, val string) error {
-// 	u := rrd.NewUpdater(dbfile)
-// 	if err := u.Update(time, val); err != nil {
-// 		l.Printf(h.DEBUG, "Update is failed RRD DB: %s, time: %s, val: %s, error: %s", dbfile, time.Format("2006-01-02 15:04:05"), val, err)
-// 		return err
-// 	}
-// 	l.Printf(h.DEBUG, "Update RRD DB: %s, time: %s, val: %s", dbfile, time.Format("2006-01-02 15:04:05"), val)
-// 	return nil
-// }
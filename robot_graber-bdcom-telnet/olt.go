@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//
+// OLT drivers - vendor specific part of grabber: how ONUs, their levels, client MACs and inactive
+// ONUs are fetched from OLT. Pipeline of robot is the same for all drivers: levels are stored in
+// sinks, ONUs with clients are written by update_user_onu, inactive ONUs - to table onu
+//
+
+//
+// OltDevice struct for store OLT selected from table epon
+//
+type OltDevice struct {
+	sqlId     string
+	hostname  string
+	ip        string
+	driver    string
+	transport string // CLI transport: telnet, ssh
+	login     string
+	password  string
+	snmpVer   string
+	community string
+}
+
+//
+// Onu struct for store ONU fetched from OLT, fields which driver can not fetch are empty
+//
+type Onu struct {
+	Name        string  // name of ONU iface on OLT, e.g. EPON0/1:1, GPON0/1:1
+	MAC         string  // identity of EPON ONU, XX:XX:XX:XX:XX:XX
+	Serial      string  // identity of GPON ONU, e.g. BDCM00A1B2C3
+	Technology  string  // epon, gpon
+	Tx          float64 // optical levels, dBm
+	Rx          float64
+	Distance    string
+	RTT         string
+	DeregReason string
+}
+
+//
+// OltDriver interface of vendor specific access to OLT, driver opens connections on demand
+// and closes them by Close
+//
+type OltDriver interface {
+	// ListOnus - return registered (active) ONUs
+	ListOnus() ([]*Onu, error)
+	// OpticalLevels - return ONUs with Tx/Rx levels, ONUs without levels are skipped
+	OpticalLevels() ([]*Onu, error)
+	// OnuMacs - return MACs of clients behind ONU, XX:XX:XX:XX:XX:XX
+	OnuMacs(onu *Onu) ([]string, error)
+	// InactiveOnus - return deregistered ONUs with reason of deregistration
+	InactiveOnus() ([]*Onu, error)
+	// Close - close connections to OLT
+	Close()
+}
+
+var oltDrivers = map[string]func(*OltDevice) OltDriver{
+	"bdcom-epon": NewBdcomEpon,
+	"bdcom-gpon": NewBdcomGpon,
+}
+
+//
+// ID - return identity of ONU: serial number of GPON ONU, MAC of EPON ONU
+//
+func (o *Onu) ID() string {
+	if o.Serial != "" {
+		return o.Serial
+	}
+	return o.MAC
+}
+
+//
+// onuLevel - return level in dBm of value in 0.1 dBm fetched from OLT, false if it is not number
+//
+func onuLevel(val string) (float64, bool) {
+	level, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+	if err != nil {
+		return 0, false
+	}
+	return level / 10, true
+}
+
+//
+// NewOltDriver - return driver of OLT by its name
+//
+func NewOltDriver(olt *OltDevice) (OltDriver, error) {
+	factory, ok := oltDrivers[olt.driver]
+	if !ok {
+		return nil, fmt.Errorf("unknown OLT driver: %s", olt.driver)
+	}
+	return factory(olt), nil
+}
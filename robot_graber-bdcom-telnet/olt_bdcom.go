@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	h "github.com/a4lex/go-helpers"
+	"github.com/gosnmp/gosnmp"
+)
+
+const (
+	oidName      = ".1.3.6.1.4.1.3320.9.64.4.1.1.2"
+	oidFDB       = ".1.3.6.1.4.1.3320.152.1.1.3"
+	oidMAC       = ".1.3.6.1.4.1.3320.101.10.1.1.3"
+	oidLevelOnu  = ".1.3.6.1.4.1.3320.101.10.5.1.5"
+	oidLevelPon0 = ".1.3.6.1.4.1.3320.9.183.1.1.5"
+	oidLevelPon1 = ".1.3.6.1.4.1.3320.101.108.1.3"
+)
+
+var (
+	reIfEponName, reActiveOnu, reInactiveOnu, reClientFDB, reFormatMAC *regexp.Regexp
+)
+
+func init() {
+	//
+	// Init RegExp
+	//
+
+	reIfEponName = regexp.MustCompile(`(?i)^(EPON\d+\/\d+:\d+)$`)
+	reActiveOnu = regexp.MustCompile(`(?i)(EPON\d+\/\d+:\d+)\s+([a-f\d\.]{14})\s+([\w\-]+)\s+([\w\-]+)\s+(\d+)\s+(\d+)\s+(\d{4}[\.-]\d{2}[\.-]\d{2}[\.\s]\d{2}\:\d{2}\:\d{2})\s+(\d{4}[\.-]\d{2}[\.-]\d{2}[\.\s]\d{2}\:\d{2}\:\d{2})\s+([\w\-\_]+)\s+(\d+\.\d{2}\:\d{2}\:\d{2})`)
+	reInactiveOnu = regexp.MustCompile(`(?i)(EPON\d+\/\d+:\d+)\s+([a-f\d\.]{14})\s+([\w]+)\s+(\d{4}[\.-]\d{2}[\.-]\d{2}[\.\s]\d{2}\:\d{2}\:\d{2})\s+(\d{4}[\.-]\d{2}[\.-]\d{2}[\.\s]\d{2}\:\d{2}\:\d{2})\s+([\w\-\_]+)\s+(\d+\.\d{2}\:\d{2}\:\d{2})`)
+	// reRXlLevel = regexp.MustCompile(`(?i)(EPON\d+\/\d+:\d+)\s+(\-\d+\.\d+)`)
+	reClientFDB = regexp.MustCompile(`(?i)([a-f0-9]{4}\.[a-f0-9]{4}\.[a-f0-9]{4})`)
+	reFormatMAC = regexp.MustCompile(`(?i)([a-f0-9]{2})([a-f0-9]{2})\.([a-f0-9]{2})([a-f0-9]{2})\.([a-f0-9]{2})([a-f0-9]{2})`)
+}
+
+//
+// bdcomSession - SNMP and CLI sessions of BDCOM OLT, shared by EPON and GPON drivers
+//
+type bdcomSession struct {
+	olt        *OltDevice
+	snmp       *gosnmp.GoSNMP
+	cli        CliSession
+	addr       string // address of CLI
+	reconnects int
+}
+
+//
+// bdcomEpon - driver of BDCOM EPON OLT: levels are fetched via SNMP, ONUs and client MACs
+// via CLI
+//
+type bdcomEpon struct {
+	bdcomSession
+}
+
+//
+// NewBdcomEpon - return driver of BDCOM EPON OLT
+//
+func NewBdcomEpon(olt *OltDevice) OltDriver {
+	return &bdcomEpon{bdcomSession{olt: olt, reconnects: *telnetRetries}}
+}
+
+//
+// OpticalLevels - walk ONU names, MACs and levels, ONUs without levels are skipped
+//
+func (d *bdcomEpon) OpticalLevels() ([]*Onu, error) {
+	con, err := d.snmpCon()
+	if err != nil {
+		return nil, err
+	}
+
+	var rowResult [5]string
+	onus := make([]*Onu, 0)
+
+	rows, err := WalkTable(con, []string{oidName, oidMAC, oidLevelOnu, oidLevelPon0, oidLevelPon1})
+	if err != nil {
+		err = fmt.Errorf("walk error: %v", err)
+	}
+	for _, row := range rows {
+		for id, snmpPDU := range row.Values {
+			rowResult[id] = SnmpValueString(snmpPDU)
+		}
+		// skip ONU without levels
+		if row.Values[0] == nil || row.Values[1] == nil || row.Values[2] == nil || row.Values[3] == nil ||
+			(rowResult[3] == "1" && row.Values[4] == nil) {
+			continue
+		}
+
+		// levels are in 0.1 dBm, rx of ONU is in other table on some firmwares
+		tx, okTx := onuLevel(rowResult[2])
+		rx, okRx := onuLevel(rowResult[3])
+		if rowResult[3] == "1" {
+			rx, okRx = onuLevel(rowResult[4])
+		}
+		if reIfEponName.Match([]byte(rowResult[0])) && rowResult[3] != "-65535" && rowResult[4] != "-65535" && okTx && okRx {
+			onus = append(onus, &Onu{
+				Name:       strings.ToUpper(rowResult[0]),
+				MAC:        strings.ToUpper(fmt.Sprintf("%v", net.HardwareAddr(rowResult[1]))),
+				Technology: "epon",
+				Tx:         tx,
+				Rx:         rx,
+			})
+		}
+	}
+	return onus, err
+}
+
+//
+// ListOnus - parse 'show epon active-onu'
+//
+func (d *bdcomEpon) ListOnus() ([]*Onu, error) {
+	t, err := d.exec("show epon active-onu")
+	if err != nil {
+		return nil, err
+	}
+
+	onus := make([]*Onu, 0)
+	for _, onu := range t.FindAllStringSubmatch(reActiveOnu) {
+		onus = append(onus, &Onu{
+			Name:        strings.ToUpper(onu[1]),
+			MAC:         bdcomMAC(onu[2]),
+			Technology:  "epon",
+			Distance:    onu[5],
+			RTT:         onu[6],
+			DeregReason: onu[9],
+		})
+	}
+	return onus, nil
+}
+
+//
+// OnuMacs - parse 'show mac address-table dynamic interface', MAC of ONU itself is skipped
+//
+func (d *bdcomSession) OnuMacs(onu *Onu) ([]string, error) {
+	t, err := d.exec("show mac address-table dynamic interface %s", onu.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	macs := make([]string, 0)
+	for _, mac := range t.FindAllString(reClientFDB) {
+		if mac = bdcomMAC(mac); mac != onu.MAC {
+			macs = append(macs, mac)
+		}
+	}
+	return macs, nil
+}
+
+//
+// InactiveOnus - parse 'show epon inactive-onu'
+//
+func (d *bdcomEpon) InactiveOnus() ([]*Onu, error) {
+	t, err := d.exec("show epon inactive-onu")
+	if err != nil {
+		return nil, err
+	}
+
+	onus := make([]*Onu, 0)
+	for _, onu := range t.FindAllStringSubmatch(reInactiveOnu) {
+		onus = append(onus, &Onu{
+			Name:        strings.ToUpper(onu[1]),
+			MAC:         bdcomMAC(onu[2]),
+			Technology:  "epon",
+			DeregReason: onu[6],
+		})
+	}
+	return onus, nil
+}
+
+//
+// Close - logout from CLI and close SNMP connection
+//
+func (d *bdcomSession) Close() {
+	if d.cli != nil && d.cli.IsConnected() {
+		d.cli.
+			SendLine("exit").
+			Expect(">").
+			SendLine("exit")
+	}
+	if d.cli != nil {
+		d.cli.Close()
+	}
+	if d.snmp != nil {
+		d.snmp.Conn.Close()
+	}
+}
+
+//
+// snmpCon - return SNMP connection to OLT, it is opened by first call
+//
+func (d *bdcomSession) snmpCon() (*gosnmp.GoSNMP, error) {
+	if d.snmp == nil {
+		con := GetSnmpCon(d.olt.ip, d.olt.snmpVer, d.olt.community)
+		if err := con.Connect(); err != nil {
+			return nil, fmt.Errorf("connect error: %v", err)
+		}
+		d.snmp = con
+	}
+	return d.snmp, nil
+}
+
+//
+// exec - run command in CLI and read its output till prompt
+//
+func (d *bdcomSession) exec(command string, args ...interface{}) (CliSession, error) {
+	cli, err := d.session()
+	if err != nil {
+		return nil, err
+	}
+	if !cli.SendLine(command, args...).ReadUntil('#').IsConnected() {
+		return nil, fmt.Errorf("can not exec command '%s' on %s", fmt.Sprintf(command, args...), d.addr)
+	}
+	return cli, nil
+}
+
+//
+// session - return authorized CLI session (telnet or SSH by transport of OLT),
+// lost session is reconnected while attempts are left
+//
+func (d *bdcomSession) session() (CliSession, error) {
+	if d.cli == nil {
+		l.Printf(h.INFO, "Try connect to %s (%s)", d.olt.ip, d.olt.transport)
+
+		cli, addr, err := CliConnect(d.olt.transport, d.olt.ip, d.olt.login, d.olt.password, time.Duration(*telnetTimeout)*(time.Second),
+			func(msg string) { l.Printf(h.INFO, msg) })
+		d.addr = addr
+		if err != nil {
+			return nil, fmt.Errorf("can not connect to %s, error: %s", addr, err)
+		}
+
+		d.cli = cli
+		d.authorize()
+
+		if !cli.IsConnected() {
+			return nil, fmt.Errorf("can not authorize on %s", addr)
+		}
+		l.Printf(h.INFO, "Success auth on %s", addr)
+	}
+
+	if !d.cli.IsConnected() && d.reconnects > 0 {
+		d.reconnects--
+		d.cli.Reconnect()
+		d.authorize()
+		l.Printf(h.INFO, "Try reconnect to %s, attempt for reconnect: %d", d.addr, d.reconnects)
+	}
+	if !d.cli.IsConnected() {
+		return nil, fmt.Errorf("lost connection to %s", d.addr)
+	}
+	return d.cli, nil
+}
+
+//
+// authorize - login by telnet dialog (SSH session is authorized by transport) and enter privileged mode
+//
+func (d *bdcomSession) authorize() {
+	if d.olt.transport == "" || d.olt.transport == "telnet" {
+		d.cli.
+			Expect("sername: ").
+			SendLine(d.olt.login).
+			Expect("assword: ").
+			SendLine(d.olt.password)
+	}
+	d.cli.
+		Expect(">").
+		SendLine("enable").
+		Expect("assword:", "#").
+		SendLine(d.olt.password).
+		Expect("#")
+}
+
+//
+// bdcomMAC - return MAC xxxx.xxxx.xxxx as XX:XX:XX:XX:XX:XX
+//
+func bdcomMAC(mac string) string {
+	return strings.ToUpper(reFormatMAC.ReplaceAllString(mac, "$1:$2:$3:$4:$5:$6"))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	oidGponName     = ".1.3.6.1.2.1.2.2.1.2"         // ifDescr, GPON0/1:1
+	oidGponSerial   = ".1.3.6.1.4.1.3320.10.3.3.1.4" // serial number of ONU, 4 chars of vendor + 4 bytes
+	oidGponLevelOnu = ".1.3.6.1.4.1.3320.10.3.4.1.2" // level received by ONU, 0.1 dBm
+	oidGponLevelOlt = ".1.3.6.1.4.1.3320.10.3.4.1.3" // level of ONU received by OLT, 0.1 dBm
+	gponNoLevel     = "-65535"
+)
+
+var (
+	reIfGponName, reActiveGponOnu, reInactiveGponOnu *regexp.Regexp
+)
+
+func init() {
+	//
+	// Init RegExp
+	//
+
+	reIfGponName = regexp.MustCompile(`(?i)^(GPON\d+\/\d+:\d+)$`)
+	// GPON0/1:1  BDCM  P1501C1  BDCM00A1B2C3  N/A  active  success  2021-03-04 10:11:12
+	reActiveGponOnu = regexp.MustCompile(`(?i)(GPON\d+\/\d+:\d+)\s+([\w\-]+)\s+([\w\-]+)\s+([a-z\d]{4}[a-f\d]{8})\s+(\S+)\s+active\s+([\w\-]+)`)
+	// GPON0/1:2  BDCM  P1501C1  BDCM00A1B2C4  N/A  inactive  success  dying-gasp  2021-03-04 10:11:12
+	reInactiveGponOnu = regexp.MustCompile(`(?i)(GPON\d+\/\d+:\d+)\s+([\w\-]+)\s+([\w\-]+)\s+([a-z\d]{4}[a-f\d]{8})\s+(\S+)\s+inactive\s+([\w\-]+)\s+([\w\-]+)`)
+}
+
+//
+// bdcomGpon - driver of BDCOM GPON OLT (GP3600 series): ONU is identified by serial number,
+// levels are fetched via SNMP, ONUs and client MACs via CLI
+//
+type bdcomGpon struct {
+	bdcomSession
+}
+
+//
+// NewBdcomGpon - return driver of BDCOM GPON OLT
+//
+func NewBdcomGpon(olt *OltDevice) OltDriver {
+	return &bdcomGpon{bdcomSession{olt: olt, reconnects: *telnetRetries}}
+}
+
+//
+// OpticalLevels - walk ONU names, serial numbers and levels, ONUs without levels are skipped
+//
+func (d *bdcomGpon) OpticalLevels() ([]*Onu, error) {
+	con, err := d.snmpCon()
+	if err != nil {
+		return nil, err
+	}
+
+	var rowResult [4]string
+	onus := make([]*Onu, 0)
+
+	rows, err := WalkTable(con, []string{oidGponName, oidGponSerial, oidGponLevelOnu, oidGponLevelOlt})
+	if err != nil {
+		err = fmt.Errorf("walk error: %v", err)
+	}
+	for _, row := range rows {
+		// skip ifaces which are not ONU and ONU without levels
+		if row.Values[0] == nil || row.Values[1] == nil || row.Values[2] == nil || row.Values[3] == nil {
+			continue
+		}
+		for id, snmpPDU := range row.Values {
+			rowResult[id] = SnmpValueString(snmpPDU)
+		}
+
+		tx, okTx := onuLevel(rowResult[2])
+		rx, okRx := onuLevel(rowResult[3])
+		if reIfGponName.MatchString(rowResult[0]) && rowResult[2] != gponNoLevel && rowResult[3] != gponNoLevel && okTx && okRx {
+			onus = append(onus, &Onu{
+				Name:       strings.ToUpper(rowResult[0]),
+				Serial:     gponSerial(rowResult[1]),
+				Technology: "gpon",
+				Tx:         tx,
+				Rx:         rx,
+			})
+		}
+	}
+	return onus, err
+}
+
+//
+// ListOnus - parse 'show gpon active-onu', it has no distance and reason of last deregistration
+//
+func (d *bdcomGpon) ListOnus() ([]*Onu, error) {
+	t, err := d.exec("show gpon active-onu")
+	if err != nil {
+		return nil, err
+	}
+
+	onus := make([]*Onu, 0)
+	for _, onu := range t.FindAllStringSubmatch(reActiveGponOnu) {
+		onus = append(onus, &Onu{
+			Name:       strings.ToUpper(onu[1]),
+			Serial:     strings.ToUpper(onu[4]),
+			Technology: "gpon",
+		})
+	}
+	return onus, nil
+}
+
+//
+// InactiveOnus - parse 'show gpon inactive-onu'
+//
+func (d *bdcomGpon) InactiveOnus() ([]*Onu, error) {
+	t, err := d.exec("show gpon inactive-onu")
+	if err != nil {
+		return nil, err
+	}
+
+	onus := make([]*Onu, 0)
+	for _, onu := range t.FindAllStringSubmatch(reInactiveGponOnu) {
+		onus = append(onus, &Onu{
+			Name:        strings.ToUpper(onu[1]),
+			Serial:      strings.ToUpper(onu[4]),
+			Technology:  "gpon",
+			DeregReason: onu[7],
+		})
+	}
+	return onus, nil
+}
+
+//
+// gponSerial - return serial number of ONU as it is shown by CLI: vendor ID and 8 hex digits
+//
+func gponSerial(raw string) string {
+	if len(raw) == 8 && isGponVendor(raw[:4]) {
+		return strings.ToUpper(raw[:4] + hex.EncodeToString([]byte(raw[4:])))
+	}
+	return strings.ToUpper(strings.TrimSpace(raw))
+}
+
+//
+// isGponVendor - vendor ID of serial number is 4 alphanumeric chars
+//
+func isGponVendor(vendor string) bool {
+	for i := 0; i < len(vendor); i++ {
+		if c := vendor[i]; !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -3,43 +3,26 @@ package main
 import (
 	"flag"
 	"fmt"
-	"net"
+	"math"
+	"math/big"
 	"os"
-	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	h "github.com/a4lex/go-helpers"
-	"github.com/gosnmp/gosnmp"
-	"github.com/ziutek/rrd"
 )
 
-type EponDevice struct {
-	sqlId     string
-	hostname  string
-	ip        string
-	login     string
-	password  string
-	snmpVer   string
-	community string
-}
-
 const (
-	oidName      = ".1.3.6.1.4.1.3320.9.64.4.1.1.2"
-	oidFDB       = ".1.3.6.1.4.1.3320.152.1.1.3"
-	oidMAC       = ".1.3.6.1.4.1.3320.101.10.1.1.3"
-	oidLevelOnu  = ".1.3.6.1.4.1.3320.101.10.5.1.5"
-	oidLevelPon0 = ".1.3.6.1.4.1.3320.9.183.1.1.5"
-	oidLevelPon1 = ".1.3.6.1.4.1.3320.101.108.1.3"
-
-	sqlGetEponList = `SELECT id, name AS hostname, INET_NTOA(ip) AS ip, snmp_ro AS comunity, 'admin' AS login, 'gunck7iaf' AS password ` +
+	sqlGetEponList = `SELECT id, name AS hostname, INET_NTOA(ip) AS ip, snmp_ro AS comunity, credential_id, driver, cli_transport ` +
 		`FROM epon WHERE name NOT LIKE 'fake%'AND id>0 AND country = ?`
-	sqlGetEponByName = `SELECT id, name AS hostname, INET_NTOA(ip) AS ip, snmp_ro AS comunity, 'admin' AS login, 'gunck7iaf' AS password ` +
+	sqlGetEponByName = `SELECT id, name AS hostname, INET_NTOA(ip) AS ip, snmp_ro AS comunity, credential_id, driver, cli_transport ` +
 		`FROM epon WHERE name NOT LIKE 'fake%'AND id>0 AND country = ? AND name = ? LIMIT 1`
 
-	sqlCallUpdateUseroOnu = `CALL update_user_onu(create_or_update_onu(?, ?, ?, ?, ?, ?, ?, ?), ?)`
-	sqlUpdateInactiveOnu  = `UPDATE onu SET change_state=IF(dereg_reason=?, 0, 1), dereg_reason=? WHERE eponid=? AND mac=? LIMIT 1`
+	sqlCallUpdateUseroOnu  = `CALL update_user_onu(create_or_update_onu(?, ?, ?, ?, ?, ?, ?, ?), ?)`
+	sqlUpdateInactiveOnu   = `UPDATE onu SET change_state=IF(dereg_reason=?, 0, 1), dereg_reason=?, technology=? WHERE eponid=? AND mac=? LIMIT 1`
+	sqlUpdateOnuTechnology = `UPDATE onu SET technology=? WHERE eponid=? AND technology<>?`
 
 	sqlInsertTaskForSendMail = `CALL ADD_TASK('epon check_pon_line all', 'radius', 'self')`
 	sqlCheckBrokenLine       = `` +
@@ -49,37 +32,27 @@ const (
 )
 
 var (
-	telnetTimeout = flag.Int("telnet-timeout", 30, "Telnet Timeout for waiting responce from device")
-	telnetRetries = flag.Int("telnet-retries", 3, "Telnet Retries connect to device")
+	telnetTimeout = flag.Int("telnet-timeout", 30, "Timeout for waiting responce from device CLI (telnet, ssh)")
+	telnetRetries = flag.Int("telnet-retries", 3, "Retries reconnect to device CLI (telnet, ssh)")
 
 	eponName         = flag.String("epon", "", "Epon Name to fetch level")
 	eponCountry      = flag.String("country", "", "Epon Country to fetch level")
 	ifChStatePercent = flag.String("ifchst-per", "25", "Epon Country to fetch level")
 	ifChStateCount   = flag.String("ifchst-count", "5", "Epon Country to fetch level")
+	eponCredential   = flag.String("credential", "bdcom", "Name of credential profile for Epon without own credential_id")
+	eponDriver       = flag.String("driver", "bdcom-epon", "OLT driver for Epon without own driver")
 
 	chanQuery chan h.Query
-
-	reIfEponName, reActiveOnu, reInactiveOnu, reClientFDB, reFormatMAC *regexp.Regexp
 )
 
-func init() {
-	//
-	// Init RegExp
-	//
-
-	reIfEponName = regexp.MustCompile(`(?i)^(EPON\d+\/\d+:\d+)$`)
-	reActiveOnu = regexp.MustCompile(`(?i)(EPON\d+\/\d+:\d+)\s+([a-f\d\.]{14})\s+([\w\-]+)\s+([\w\-]+)\s+(\d+)\s+(\d+)\s+(\d{4}[\.-]\d{2}[\.-]\d{2}[\.\s]\d{2}\:\d{2}\:\d{2})\s+(\d{4}[\.-]\d{2}[\.-]\d{2}[\.\s]\d{2}\:\d{2}\:\d{2})\s+([\w\-\_]+)\s+(\d+\.\d{2}\:\d{2}\:\d{2})`)
-	reInactiveOnu = regexp.MustCompile(`(?i)(EPON\d+\/\d+:\d+)\s+([a-f\d\.]{14})\s+([\w]+)\s+(\d{4}[\.-]\d{2}[\.-]\d{2}[\.\s]\d{2}\:\d{2}\:\d{2})\s+(\d{4}[\.-]\d{2}[\.-]\d{2}[\.\s]\d{2}\:\d{2}\:\d{2})\s+([\w\-\_]+)\s+(\d+\.\d{2}\:\d{2}\:\d{2})`)
-	// reRXlLevel = regexp.MustCompile(`(?i)(EPON\d+\/\d+:\d+)\s+(\-\d+\.\d+)`)
-	reClientFDB = regexp.MustCompile(`(?i)([a-f0-9]{4}\.[a-f0-9]{4}\.[a-f0-9]{4})`)
-	reFormatMAC = regexp.MustCompile(`(?i)([a-f0-9]{2})([a-f0-9]{2})\.([a-f0-9]{2})([a-f0-9]{2})\.([a-f0-9]{2})([a-f0-9]{2})`)
-}
-
 func process() {
 
 	timeUpdRRD = time.Now()
 	l.Printf(h.DEBUG, "Time for RRD DB update fixed to: %s", timeUpdRRD.Format("2006-01-02 15:04:05"))
 
+	// ONU levels are stored with step 300 sec
+	UpdateCycleStep(300)
+
 	wgQueryQueue := &sync.WaitGroup{}
 	chanQuery := mysqli.InitQueryQueue(wgQueryQueue)
 
@@ -96,7 +69,7 @@ func process() {
 
 	// start N-workers
 	wgEponQueue := &sync.WaitGroup{}
-	eponChannel := make(chan *EponDevice)
+	eponChannel := make(chan *OltDevice)
 	for i := 0; i < *threadCount; i++ {
 		wgEponQueue.Add(1)
 		go grabeEponQueue(wgEponQueue, i, chanQuery, eponChannel)
@@ -104,7 +77,30 @@ func process() {
 
 	// pick data from EPON and store it in DB
 	for _, dev := range listDevice {
-		eponChannel <- &EponDevice{dev["id"], dev["hostname"], dev["ip"], dev["login"], dev["password"], "v2c", dev["comunity"]}
+		if isStopping() {
+			break
+		}
+		cred := GetCredential(dev["credential_id"])
+		if cred == nil {
+			cred = GetCredentialByName(*eponCredential)
+		}
+		if cred == nil {
+			l.Printf(h.ERROR, "Epon %s: credential is not found (credential_id: %s, -credential: %s)", dev["hostname"], dev["credential_id"], *eponCredential)
+			continue
+		}
+		community := dev["comunity"]
+		if cred.Community != "" {
+			community = cred.Community
+		}
+		driver := dev["driver"]
+		if driver == "" {
+			driver = *eponDriver
+		}
+		transport := dev["cli_transport"]
+		if transport == "" {
+			transport = *cliTransport
+		}
+		eponChannel <- &OltDevice{dev["id"], dev["hostname"], dev["ip"], driver, transport, cred.Login, cred.Password, "v2c", community}
 	}
 
 	close(eponChannel)
@@ -112,275 +108,197 @@ func process() {
 
 	if send_mail, ok := mysqli.DBSelectRow(sqlCheckBrokenLine, *ifChStatePercent, *ifChStateCount)["send_mail"]; ok && send_mail == "TRUE" {
 		mysqli.DBQuery(sqlInsertTaskForSendMail)
+		notifiers.Send("critical", "Broken PON lines",
+			fmt.Sprintf("More than %s%% (min %s) ONUs changed state on the same PON line", *ifChStatePercent, *ifChStateCount))
 	}
 
 	close(chanQuery)
 	wgQueryQueue.Wait()
 }
 
-func grabeEponQueue(wg *sync.WaitGroup, num int, chanQuery chan h.Query, eponChannel chan *EponDevice) {
+func grabeEponQueue(wg *sync.WaitGroup, num int, chanQuery chan h.Query, eponChannel chan *OltDevice) {
 	defer wg.Done()
 
 	funcName := fmt.Sprintf("grabeEponQueue[%d]", num)
 	start := time.Now().Unix()
 	l.Printf(h.FUNC, "Start: %s", funcName)
 
-	snmpQuery := make([]string, 0)
-
-	var err error
-	var nextID string
-	var rowResult [5]string
-	var snmpResult *gosnmp.SnmpPacket
-	var eponIfList map[string]map[string]string
-
-	var telnetConnectAttempt int
-
 	for epon := range eponChannel {
-
-		eponIfList = make(map[string]map[string]string)
-
-		// THIS IS LEGACY
-		rrdDbPath := fmt.Sprintf("%s/%s", *dirRRD, epon.sqlId)
-		if _, err := os.Stat(rrdDbPath); os.IsNotExist(err) {
-			os.MkdirAll(rrdDbPath, os.ModePerm)
-			l.Printf(h.INFO, "Create dir for RRD files: %s", rrdDbPath)
-		}
-
-		//
-		// Fetch iface info via SNMP
-		//
-
-		snmpQuery = []string{oidName, oidMAC, oidLevelOnu, oidLevelPon0, oidLevelPon1}
-		snmpInst := GetSnmpCon(epon.ip, epon.snmpVer, epon.community)
-		if err = snmpInst.Connect(); err != nil {
-			l.Printf(h.INFO, "%s: Host %s got connect error: %v", funcName, epon.ip, err)
+		driver, err := NewOltDriver(epon)
+		if err != nil {
+			l.Printf(h.ERROR, "%s: host %s: %s", funcName, epon.ip, err)
 			continue
 		}
-		defer snmpInst.Conn.Close()
+		grabeEpon(funcName, driver, epon, chanQuery)
+		driver.Close()
+	}
 
-		for {
-			if snmpResult, err = snmpInst.GetNext(snmpQuery); err != nil || !strings.HasPrefix(snmpResult.Variables[0].Name, oidName) {
-				break
-			}
+	l.Printf(h.FUNC, "Stop: %s - %d, diration: %d", funcName, time.Now().Unix(), time.Now().Unix()-start)
+}
 
-			for id, snmpPDU := range snmpResult.Variables {
-				if id == 0 {
-					snmpQuery[0] = snmpPDU.Name
-					nextID = strings.Replace(snmpQuery[0], oidName, "", -1)
-					snmpQuery[1] = fmt.Sprintf("%s%s", oidMAC, nextID)
-					snmpQuery[2] = fmt.Sprintf("%s%s", oidLevelOnu, nextID)
-					snmpQuery[3] = fmt.Sprintf("%s%s", oidLevelPon0, nextID)
-					snmpQuery[4] = fmt.Sprintf("%s%s", oidLevelPon1, nextID)
-				}
+//
+// grabeEpon - store levels of ONUs, clients of active ONUs and state of inactive ONUs fetched by driver
+//
+func grabeEpon(funcName string, driver OltDriver, epon *OltDevice, chanQuery chan h.Query) {
 
-				switch snmpPDU.Type {
-				case gosnmp.OctetString:
-					rowResult[id] = string(snmpPDU.Value.([]byte))
-				default:
-					rowResult[id] = gosnmp.ToBigInt(snmpPDU.Value).String()
-				}
-			}
+	// THIS IS LEGACY
+	rrdDbPath := fmt.Sprintf("%s/%s", *dirRRD, epon.sqlId)
+	if _, err := os.Stat(rrdDbPath); os.IsNotExist(err) {
+		os.MkdirAll(rrdDbPath, os.ModePerm)
+		l.Printf(h.INFO, "Create dir for RRD files: %s", rrdDbPath)
+	}
 
-			if reIfEponName.Match([]byte(rowResult[0])) && rowResult[3] != "-65535" && rowResult[4] != "-65535" {
-				ifName := strings.ToUpper(rowResult[0])
-				eponIfList[ifName] = make(map[string]string)
-				eponIfList[ifName]["mac"] = strings.ToUpper(fmt.Sprintf("%v", net.HardwareAddr(rowResult[1])))
-				eponIfList[ifName]["tx"] = rowResult[2]
-				if rowResult[3] == "1" {
-					eponIfList[ifName]["rx"] = rowResult[4]
-				} else {
-					eponIfList[ifName]["rx"] = rowResult[3]
-				}
+	//
+	// Fetch ONU levels
+	//
 
-				//
-				// THIS IS LEGACY
-				// we don't need to update RDD-DB here
-				// For this we have a special robot_updater-rrd
-				// But now not enough time for it implementation and installation
-				//
-				tx := fmt.Sprintf("%s.%s", eponIfList[ifName]["tx"][0:len(eponIfList[ifName]["tx"])-1], eponIfList[ifName]["tx"][len(eponIfList[ifName]["tx"])-1:])
-				rx := fmt.Sprintf("%s.%s", eponIfList[ifName]["rx"][0:len(eponIfList[ifName]["rx"])-1], eponIfList[ifName]["rx"][len(eponIfList[ifName]["rx"])-1:])
-				rrdDbPath := fmt.Sprintf("%s/%s/%s", *dirRRD, epon.sqlId, strings.ToLower(strings.ReplaceAll(eponIfList[ifName]["mac"], ":", "")))
-				if err := LEGACY_RRDUpdate(rrdDbPath, timeUpdRRD, tx, rx); err != nil {
-					if _, err := os.Stat(rrdDbPath); os.IsNotExist(err) {
-						if _, err := LEGACY_RRDCreate(rrdDbPath, "GAUGE", -50, 0, 300); err != nil {
-							l.Printf(h.ERROR, "Can not create rrddb: %s - %s", rrdDbPath, err)
-						}
-					}
-				}
-			}
-		}
+	levels, err := driver.OpticalLevels()
+	if err != nil {
+		l.Printf(h.INFO, "%s: Host %s got levels error: %v", funcName, epon.ip, err)
+	}
+
+	onuLevels := make(map[string]*Onu, len(levels))
+	for _, onu := range levels {
+		onuLevels[onu.Name] = onu
 
 		//
-		// Connect to BDCom
+		// THIS IS LEGACY
+		// we don't need to update RDD-DB here
+		// For this we have a special robot_updater-rrd
+		// But now not enough time for it implementation and installation
 		//
-
-		telnetConnectAttempt = *telnetRetries
-
-		l.Printf(h.INFO, fmt.Sprintf("Try connect to %s:23", epon.ip))
-
-		t, err := h.TelnetConnect("tcp", fmt.Sprintf("%s:23", epon.ip), time.Duration(*telnetTimeout)*(time.Second),
-			func(msg string) { l.Printf(h.INFO, msg) })
-
-		if err != nil {
-			l.Printf(h.ERROR, fmt.Sprintf("Can not connect to %s:23, error: %s", epon.ip, err))
-			continue
+		tx := strconv.FormatFloat(onu.Tx, 'f', 1, 64)
+		rx := strconv.FormatFloat(onu.Rx, 'f', 1, 64)
+		onuID := strings.ToLower(strings.ReplaceAll(onu.ID(), ":", ""))
+		rrdDbPath := fmt.Sprintf("%s/%s/%s", *dirRRD, epon.sqlId, onuID)
+		if err := LEGACY_RRDUpdate(rrdDbPath, timeUpdRRD, tx, rx); err != nil {
+			if _, err := os.Stat(rrdDbPath); os.IsNotExist(err) {
+				if err := LEGACY_RRDCreate(rrdDbPath, timeUpdRRD.Add(-10*time.Second), "GAUGE", -50, 0, 300); err != nil {
+					l.Printf(h.ERROR, "Can not create rrddb: %s - %s", rrdDbPath, err)
+				} else {
+					LEGACY_RRDUpdate(rrdDbPath, timeUpdRRD, tx, rx)
+				}
+			}
 		}
 
-		t.SetUnixWriteMode(true)
-		defer t.Close()
-
 		//
-		// Authorize via telnet
+		// Store ONU levels in enabled sinks
 		//
-
-		authorize(t, epon.login, epon.password)
-
-		if !t.IsConnected() {
-			l.Printf(h.ERROR, fmt.Sprintf("Can not authorize on %s:23", epon.ip))
-			continue
+		for name, level := range map[string]float64{"onu_tx": onu.Tx, "onu_rx": onu.Rx} {
+			series := &Series{Path: "bdcom/" + name, ObjectID: onuID, DeviceID: epon.sqlId, CounterType: "GAUGE", Min: -50, Max: 0, Step: 300}
+			if err := sinks.Store(series, timeUpdRRD, big.NewFloat(level)); err != nil {
+				l.Printf(h.ERROR, "Can not store value: %s/%s - %s", series.Path, series.ObjectID, err)
+			}
 		}
+	}
 
-		l.Printf(h.INFO, fmt.Sprintf("Success auth on %s:23", epon.ip))
+	//
+	// Grabe active ONUs and their clients
+	//
 
-		//
-		// Grabe active epon iface
-		//
+	active, err := driver.ListOnus()
+	if err != nil {
+		l.Printf(h.ERROR, "%s: host %s: %s", funcName, epon.ip, err)
+		return
+	}
 
-		if !t.SendLine("show epon active-onu").ReadUntil('#').IsConnected() {
-			l.Printf(h.ERROR, fmt.Sprintf("Can not exec command 'show epon active-onu' on %s:23", epon.ip))
-			continue
+	for _, onu := range active {
+		if level, ok := onuLevels[onu.Name]; ok {
+			grabeOnuClients(funcName, driver, epon, onu, level, chanQuery)
 		}
+	}
 
-		for _, onu := range t.FindAllStringSubmatch(reActiveOnu) {
-			ifName := strings.ToUpper(onu[1])
-			if _, ok := eponIfList[ifName]; ok {
-				eponIfList[ifName]["distance"] = onu[5]
-				eponIfList[ifName]["rrt"] = onu[6]
-				eponIfList[ifName]["dereg_reason"] = onu[9]
-
-				if !t.IsConnected() && telnetConnectAttempt > 0 {
-					telnetConnectAttempt--
-					t.Reconnect()
-					authorize(t, epon.login, epon.password)
-					l.Printf(h.INFO, fmt.Sprintf("Try reconnect to %s:23, attempt for reconnect: %d", epon.ip, telnetConnectAttempt))
-				}
-				t.SendLine("show mac address-table dynamic interface %s", ifName).ReadUntil('#')
-				if !t.IsConnected() {
-					l.Printf(h.ERROR, fmt.Sprintf("Can not exec command 'show mac address-table dynamic interface %s' on %s:23", ifName, epon.ip))
-					continue
-				}
-
-				var _macs string
-				for _, mac := range t.FindAllString(reClientFDB) {
-					_mac := strings.ToUpper(reFormatMAC.ReplaceAllString(mac, "$1:$2:$3:$4:$5:$6"))
-					if _mac == eponIfList[ifName]["mac"] {
-						continue
-					}
-					_macs += _mac
-				}
-
-				if len(_macs) > 0 {
-					if len(_macs) > 255 {
-						l.Printf(h.ERROR, fmt.Sprintf("To much mac in iface: %s epon: %s. MYSQL proccedure update_user_onu(INT(16), VARCHAR(255)) can drop it", ifName, epon.ip))
-					}
-
-					chanQuery <- h.Query{Query: sqlCallUpdateUseroOnu, Args: []interface{}{
-						epon.sqlId,
-						ifName,
-						eponIfList[ifName]["mac"],
-						eponIfList[ifName]["tx"],
-						eponIfList[ifName]["rx"],
-						eponIfList[ifName]["distance"],
-						eponIfList[ifName]["rrt"],
-						eponIfList[ifName]["dereg_reason"],
-						_macs,
-					}}
+	// all ONUs of OLT have technology of its driver, also ONUs without levels and clients
+	if len(active) > 0 {
+		chanQuery <- h.Query{Query: sqlUpdateOnuTechnology, Args: []interface{}{active[0].Technology, epon.sqlId, active[0].Technology}}
+	}
 
-				}
-			}
-		}
+	//
+	// Grabe inactive ONUs
+	//
 
-		//
-		// Grabe inactive epon iface
-		//
+	inactive, err := driver.InactiveOnus()
+	if err != nil {
+		l.Printf(h.ERROR, "%s: host %s: %s", funcName, epon.ip, err)
+		return
+	}
 
-		if !t.SendLine("show epon inactive-onu").ReadUntil('#').IsConnected() {
-			l.Printf(h.ERROR, fmt.Sprintf("Can not exec command 'show epon inactive-onu' on %s:23", epon.ip))
-			continue
-		}
+	for _, onu := range inactive {
+		chanQuery <- h.Query{Query: sqlUpdateInactiveOnu, Args: []interface{}{
+			onu.DeregReason,
+			onu.DeregReason,
+			onu.Technology,
+			epon.sqlId,
+			onu.ID(),
+		}}
+	}
+}
 
-		for _, onu := range t.FindAllStringSubmatch(reInactiveOnu) {
-			chanQuery <- h.Query{Query: sqlUpdateInactiveOnu, Args: []interface{}{
-				onu[6], //dereg_reason
-				onu[6], //dereg_reason
-				epon.sqlId,
-				strings.ToUpper(reFormatMAC.ReplaceAllString(onu[2], "$1:$2:$3:$4:$5:$6")), //mac
-			}}
-		}
+//
+// grabeOnuClients - store MACs of clients behind active ONU with its levels by update_user_onu
+//
+func grabeOnuClients(funcName string, driver OltDriver, epon *OltDevice, onu, level *Onu, chanQuery chan h.Query) {
+	macs, err := driver.OnuMacs(level)
+	if err != nil {
+		l.Printf(h.ERROR, "%s: host %s: %s", funcName, epon.ip, err)
+		return
+	}
+	if len(macs) == 0 {
+		return
+	}
 
-		t.
-			SendLine("exit").
-			Expect(">").
-			SendLine("exit")
+	_macs := strings.Join(macs, "")
+	if len(_macs) > 255 {
+		l.Printf(h.ERROR, fmt.Sprintf("To much mac in iface: %s epon: %s. MYSQL proccedure update_user_onu(INT(16), VARCHAR(255)) can drop it", onu.Name, epon.ip))
 	}
 
-	l.Printf(h.FUNC, "Stop: %s - %d, diration: %d", funcName, time.Now().Unix(), time.Now().Unix()-start)
+	chanQuery <- h.Query{Query: sqlCallUpdateUseroOnu, Args: []interface{}{
+		epon.sqlId,
+		onu.Name,
+		level.ID(),
+		// levels are stored in 0.1 dBm
+		int(math.Round(level.Tx * 10)),
+		int(math.Round(level.Rx * 10)),
+		nullIfEmpty(onu.Distance),
+		nullIfEmpty(onu.RTT),
+		nullIfEmpty(onu.DeregReason),
+		_macs,
+	}}
 }
 
-func authorize(t *h.MyTelnet, login, password string) {
-	t.
-		Expect("sername: ").
-		SendLine(login).
-		Expect("assword: ").
-		SendLine(password).
-		Expect(">").
-		SendLine("enable").
-		Expect("assword:", "#").
-		SendLine(password).
-		Expect("#")
+//
+// nullIfEmpty - return nil (NULL) for value which driver can not fetch
+//
+func nullIfEmpty(val string) interface{} {
+	if val == "" {
+		return nil
+	}
+	return val
 }
 
 //
 // RRDCreate - create file of RRD DB
 //
-func LEGACY_RRDCreate(dbfile, counterType string, min, max int, step uint) (*rrd.Creator, error) {
-
-	c := rrd.NewCreator(dbfile, time.Now(), step)
-	c.DS("onu", counterType, step, min, max)
-	c.DS("pon", counterType, step, min, max)
-	c.RRA("AVERAGE", 0.5, 1, 288)
-	c.RRA("LAST", 0.5, 1, 288)
-	c.RRA("MIN", 0.5, 1, 288)
-	c.RRA("MAX", 0.5, 1, 288)
-	c.RRA("AVERAGE", 0.5, 7, 288)
-	c.RRA("LAST", 0.5, 7, 288)
-	c.RRA("MIN", 0.5, 7, 288)
-	c.RRA("MAX", 0.5, 7, 288)
-	c.RRA("AVERAGE", 0.5, 30, 288)
-	c.RRA("LAST", 0.5, 30, 288)
-	c.RRA("MIN", 0.5, 30, 288)
-	c.RRA("MAX", 0.5, 30, 288)
-	c.RRA("AVERAGE", 0.5, 365, 288)
-	c.RRA("LAST", 0.5, 365, 288)
-	c.RRA("MIN", 0.5, 365, 288)
-	c.RRA("MAX", 0.5, 365, 288)
-
-	if err := c.Create(true); err != nil {
+func LEGACY_RRDCreate(dbfile string, start time.Time, counterType string, min, max int, step uint) error {
+
+	ds := []RRDDataSource{
+		{Name: "onu", Type: counterType, Heartbeat: step, Min: float64(min), Max: float64(max)},
+		{Name: "pon", Type: counterType, Heartbeat: step, Min: float64(min), Max: float64(max)},
+	}
+
+	if err := RRDCreateFile(dbfile, start, step, ds, RRDDefaultArchives()); err != nil {
 		l.Printf(h.ERROR, "Can not create RRD DB: %s, counterType: %s, min: %d, max: %d", dbfile, counterType, min, max)
-		return nil, err
-	} else {
-		l.Printf(h.DEBUG, "Create RRD DB: %s, counterType: %s, min: %d, max: %d", dbfile, counterType, min, max)
-		return c, nil
+		return err
 	}
+	l.Printf(h.DEBUG, "Create RRD DB: %s, counterType: %s, min: %d, max: %d", dbfile, counterType, min, max)
+	return nil
 }
 
 //
 // RRDUpdate - update RRD DB file with given value and time
 //
 func LEGACY_RRDUpdate(dbfile string, time time.Time, val1, val2 string) error {
-	u := rrd.NewUpdater(dbfile)
-	if err := u.Update(time, val1, val2); err != nil {
+	if err := RRDUpdateFile(dbfile, time, val1, val2); err != nil {
 		l.Printf(h.DEBUG, "Update is failed RRD DB: %s, time: %s, val1: %s, val2: %s, error: %s", dbfile, time.Format("2006-01-02 15:04:05"), val1, val2, err)
 		return err
 	}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"math/big"
+	"net"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	h "github.com/a4lex/go-helpers"
@@ -21,35 +28,191 @@ type Device struct {
 	ip        string
 	snmpVer   string
 	community string
+	snmpV3    *SnmpV3 // nil if device has no SNMPv3 user
+	port      uint16
+	timeout   time.Duration
+	retries   int
+	maxOids   int
+}
+
+//
+// SnmpV3 struct for store USM credentials of device
+//
+type SnmpV3 struct {
+	user      string
+	authProto string
+	authKey   string
+	privProto string
+	privKey   string
 }
 
 //
 // OID strunc for store OIDs by dev_type
 //
 type OID struct {
-	rrdDir     string
+	path       string
 	query      string
 	rate       *big.Float
 	couterType string
 	min        int
 	max        int
 	step       uint
+	thresholds []*Threshold
+	extract    *regexp.Regexp // nil - octet string value is number as is
+	exprText   string         // value is computed by expression instead of query
+	expr       *Expr          // compiled by CompileExprTemplates
 }
 
 //
 // Iface2SNMP struct for store link ifID/snmpTemplate <-> snmpResponce
 //
 type Iface2SNMP struct {
-	ifaceID      string
+	ifaceID      string // empty for templates of device
+	device       *Device
 	snmpTemplate *OID
 }
 
+//
+// TableRow struct for store values of one row of SNMP table, nil - device has no value in column
+//
+type TableRow struct {
+	Index  string
+	Values []*gosnmp.SnmpPDU
+}
+
+//
+// PollSchedule struct for track when template should be polled on device next time
+//
+type PollSchedule struct {
+	mu     sync.Mutex
+	next   map[string]time.Time
+	seen   map[string]bool // keys checked by current run
+	loaded bool
+}
+
 var (
+	pollSchedule = &PollSchedule{next: make(map[string]time.Time), seen: make(map[string]bool)}
+	pollState    = flag.String("poll-state", fmt.Sprintf("%s.schedule", os.Args[0]), "File for keep schedule of templates between runs, empty - schedule is kept in memory only")
+
+	// defaults for devices without own settings in devices / device_types
+	snmpPort    = flag.Uint("snmp-port", 161, "SNMP Port of device")
 	snmpRetries = flag.Int("snmp-retries", 1, "SNMP Retries connect to device")
 	snmpTimeout = flag.Int("snmp-timeout", 3, "SNMP Timeout for waiting responce from device")
 	snmpMaxOids = flag.Int("maxOID", 20, "SNMP Max OID count per request")
+	snmpMaxReps = flag.Uint("snmp-max-repetitions", 20, "SNMP max-repetitions of GetBulk request for walk tables")
+
+	snmpAuthProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+		"": gosnmp.NoAuth, "MD5": gosnmp.MD5, "SHA": gosnmp.SHA,
+		"SHA224": gosnmp.SHA224, "SHA256": gosnmp.SHA256, "SHA384": gosnmp.SHA384, "SHA512": gosnmp.SHA512,
+	}
+	snmpPrivProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+		"": gosnmp.NoPriv, "DES": gosnmp.DES, "AES": gosnmp.AES,
+		"AES192": gosnmp.AES192, "AES256": gosnmp.AES256, "AES192C": gosnmp.AES192C, "AES256C": gosnmp.AES256C,
+	}
 )
 
+//
+// NewDevice - return device created from DB row,
+// SNMPv3 user is taken from snmp_user, snmp_auth_proto, snmp_auth_key, snmp_priv_proto, snmp_priv_key,
+// community and SNMPv3 keys are overridden by credential profile of credential_id if it has them,
+// empty snmp_port, snmp_timeout, snmp_retries, snmp_max_oids are set to defaults from flags
+//
+func NewDevice(row map[string]string) *Device {
+	dev := &Device{
+		id:        row["id"],
+		devType:   row["device_type_id"],
+		ip:        row["ip"],
+		snmpVer:   row["snmp_version"],
+		community: row["community"],
+		port:      uint16(*snmpPort),
+		timeout:   time.Duration(*snmpTimeout) * time.Second,
+		retries:   *snmpRetries,
+		maxOids:   *snmpMaxOids,
+	}
+	if port, err := strconv.ParseUint(row["snmp_port"], 10, 16); err == nil && port > 0 {
+		dev.port = uint16(port)
+	}
+	if timeout, err := strconv.Atoi(row["snmp_timeout"]); err == nil && timeout > 0 {
+		dev.timeout = time.Duration(timeout) * time.Second
+	}
+	if retries, err := strconv.Atoi(row["snmp_retries"]); err == nil && retries >= 0 {
+		dev.retries = retries
+	}
+	if maxOids, err := strconv.Atoi(row["snmp_max_oids"]); err == nil && maxOids > 0 {
+		dev.maxOids = maxOids
+	}
+	if row["snmp_user"] != "" {
+		dev.snmpV3 = &SnmpV3{
+			user:      row["snmp_user"],
+			authProto: strings.ToUpper(row["snmp_auth_proto"]),
+			authKey:   row["snmp_auth_key"],
+			privProto: strings.ToUpper(row["snmp_priv_proto"]),
+			privKey:   row["snmp_priv_key"],
+		}
+	}
+	if cred := GetCredential(row["credential_id"]); cred != nil {
+		if cred.Community != "" {
+			dev.community = cred.Community
+		}
+		if dev.snmpV3 != nil && cred.SnmpAuthKey != "" {
+			dev.snmpV3.authKey = cred.SnmpAuthKey
+		}
+		if dev.snmpV3 != nil && cred.SnmpPrivKey != "" {
+			dev.snmpV3.privKey = cred.SnmpPrivKey
+		}
+	} else if row["credential_id"] != "" {
+		l.Printf(h.ERROR, "Device %s: credential %s is not found", dev.ip, row["credential_id"])
+	}
+	return dev
+}
+
+//
+// SnmpCon - return new snmp connection to device, USM is set up for SNMPv3
+//
+func (d *Device) SnmpCon() (*gosnmp.GoSNMP, error) {
+	con := GetSnmpCon(d.ip, d.snmpVer, d.community)
+	con.Port = d.port
+	con.Timeout = d.timeout
+	con.Retries = d.retries
+	con.MaxOids = d.maxOids
+
+	if con.Version != gosnmp.Version3 {
+		return con, nil
+	}
+	if d.snmpV3 == nil {
+		return nil, fmt.Errorf("SNMPv3 user is not set")
+	}
+
+	auth, ok := snmpAuthProtocols[d.snmpV3.authProto]
+	if !ok {
+		return nil, fmt.Errorf("unknown SNMPv3 auth protocol: %s", d.snmpV3.authProto)
+	}
+	priv, ok := snmpPrivProtocols[d.snmpV3.privProto]
+	if !ok {
+		return nil, fmt.Errorf("unknown SNMPv3 priv protocol: %s", d.snmpV3.privProto)
+	}
+
+	con.MsgFlags = gosnmp.NoAuthNoPriv
+	switch {
+	case auth != gosnmp.NoAuth && priv != gosnmp.NoPriv:
+		con.MsgFlags = gosnmp.AuthPriv
+	case auth != gosnmp.NoAuth:
+		con.MsgFlags = gosnmp.AuthNoPriv
+	case priv != gosnmp.NoPriv:
+		return nil, fmt.Errorf("SNMPv3 privacy without authentication is not allowed")
+	}
+
+	con.SecurityModel = gosnmp.UserSecurityModel
+	con.SecurityParameters = &gosnmp.UsmSecurityParameters{
+		UserName:                 d.snmpV3.user,
+		AuthenticationProtocol:   auth,
+		AuthenticationPassphrase: d.snmpV3.authKey,
+		PrivacyProtocol:          priv,
+		PrivacyPassphrase:        d.snmpV3.privKey,
+	}
+	return con, nil
+}
+
 //
 // GetSnmpCon - return new snmp connection to device
 //
@@ -67,12 +230,13 @@ func GetSnmpCon(ip, snmpVer, snmpRO string) *gosnmp.GoSNMP {
 	}
 	return &gosnmp.GoSNMP{
 		Target:             ip,
-		Port:               161,
+		Port:               uint16(*snmpPort),
 		Community:          snmpRO,
 		MaxOids:            *snmpMaxOids,
 		Retries:            *snmpRetries,
 		Version:            version,
 		Timeout:            time.Duration(time.Duration(*snmpTimeout) * time.Second),
+		MaxRepetitions:     uint32(*snmpMaxReps),
 		ExponentialTimeout: true,
 	}
 }
@@ -81,47 +245,363 @@ func GetSnmpCon(ip, snmpVer, snmpRO string) *gosnmp.GoSNMP {
 // CreateSnmpTemplate Return link on new SNMP template, created from map
 //
 func CreateSnmpTemplate(t map[string]string) *OID {
-	rate := new(big.Float)
-	rate, _ = rate.SetString(t["rate"])
+	// value is multiplied by rate, empty or bad rate keeps value as is
+	rate, ok := new(big.Float).SetString(t["rate"])
+	if !ok {
+		l.Printf(h.INFO, "Template %s: bad rate '%s', 1 is used", t["path"], t["rate"])
+		rate = big.NewFloat(1)
+	}
 	min, _ := strconv.Atoi(t["min"])
 	max, _ := strconv.Atoi(t["max"])
 	step, _ := strconv.ParseUint(t["step"], 10, 32)
+	UpdateCycleStep(uint(step))
 
-	// create dir for rrd files, for current template
-	rrdDirTemplate := fmt.Sprintf("%s/%s", *dirRRD, t["path"])
-	if _, err := os.Stat(rrdDirTemplate); os.IsNotExist(err) {
-		os.MkdirAll(rrdDirTemplate, os.ModePerm)
+	thresholds, err := ParseThresholds(t["threshold"])
+	if err != nil {
+		l.Printf(h.ERROR, "Template %s: %s", t["path"], err)
+	}
+
+	var extract *regexp.Regexp
+	if t["extract"] != "" {
+		if extract, err = regexp.Compile(t["extract"]); err != nil {
+			l.Printf(h.ERROR, "Template %s: bad extract regexp: %s", t["path"], err)
+		}
+	}
+
+	// symbolic name of MIB object is resolved to numeric OID, type of object is checked by template
+	query, node, err := ResolveOID(t["query"])
+	if err != nil {
+		l.Printf(h.ERROR, "Template %s: %s", t["path"], err)
+	} else if node != nil {
+		if warn := node.CheckTemplate(t["couter_type"], extract != nil); warn != "" {
+			l.Printf(h.INFO, "Template %s: %s", t["path"], warn)
+		}
 	}
 
 	return &OID{
-		rrdDir:     rrdDirTemplate,
-		query:      t["query"],
+		path:       t["path"],
+		query:      query,
 		couterType: t["couter_type"],
 		rate:       rate,
 		min:        min,
 		max:        max,
 		step:       uint(step),
+		thresholds: thresholds,
+		extract:    extract,
+		exprText:   strings.TrimSpace(t["expr"]),
+	}
+}
+
+//
+// IsDue - return true if template should be polled on device (or device/iface type) now
+// and plan next poll, polls are aligned to template step. Template which was never polled
+// (or its schedule is lost) is due at once
+//
+func (ps *PollSchedule) IsDue(objectID string, template *OID, now time.Time) bool {
+	step := time.Duration(template.step) * time.Second
+	if step <= 0 {
+		return true
 	}
+
+	key := objectID + "/" + template.path
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.seen[key] = true
+	next, ok := ps.next[key]
+	due := !ok || !now.Before(next)
+	if due {
+		ps.next[key] = now.Truncate(step).Add(step)
+	}
+	return due
 }
 
 //
-// ParseSNMPResult - update value of givel *val
+// LoadPollSchedule - load schedule saved by previous run from -poll-state file, so robot run
+// by cron polls templates with step longer than interval of cron
 //
-func ParseSNMPResult(pdu *gosnmp.SnmpPDU, val *big.Float) error {
+func LoadPollSchedule() {
+	ps := pollSchedule
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.loaded || *pollState == "" {
+		return
+	}
+	ps.loaded = true
+
+	data, err := ioutil.ReadFile(*pollState)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &ps.next)
+	}
+	if err != nil {
+		l.Printf(h.ERROR, "Can not load poll schedule %s: %s", *pollState, err)
+		return
+	}
+	l.Printf(h.DEBUG, "Load poll schedule %s: %d templates", *pollState, len(ps.next))
+}
+
+//
+// SavePollSchedule - save schedule to -poll-state file. Templates which were due, but were not
+// checked by this run (device, iface or template is removed, device is not polled) are forgotten
+//
+func SavePollSchedule(now time.Time) {
+	ps := pollSchedule
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for key, next := range ps.next {
+		if !ps.seen[key] && !now.Before(next) {
+			delete(ps.next, key)
+		}
+	}
+	ps.seen = make(map[string]bool)
+
+	if *pollState == "" {
+		return
+	}
+	data, err := json.Marshal(ps.next)
+	if err == nil {
+		// write whole file, so broken run does not leave half of schedule
+		tmp := *pollState + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, *pollState)
+		}
+	}
+	if err != nil {
+		l.Printf(h.ERROR, "Can not save poll schedule %s: %s", *pollState, err)
+	}
+}
+
+//
+// DueTemplates - return templates which should be polled on device (or device/iface type) now
+//
+func DueTemplates(objectID string, templates []*OID, now time.Time) []*OID {
+	due := make([]*OID, 0, len(templates))
+	for _, template := range templates {
+		if pollSchedule.IsDue(objectID, template, now) {
+			due = append(due, template)
+		}
+	}
+	return due
+}
+
+//
+// WalkTable - walk columns of SNMP table, columns are fetched by GetBulk requests (GetNext for SNMPv1)
+// of at most MaxOids OIDs, rows are joined by index and returned in order of device.
+// Error of agent which can not be bypassed is returned, so truncated table is never returned without error
+//
+func WalkTable(con *gosnmp.GoSNMP, columns []string) ([]*TableRow, error) {
+	rows := make([]*TableRow, 0)
+	rowByIndex := make(map[string]*TableRow)
+
+	prefixes := make([]string, len(columns))
+	next := make([]string, len(columns))
+	active := make([]int, 0, len(columns))
+	for id, column := range columns {
+		next[id] = "." + strings.Trim(column, ".")
+		prefixes[id] = next[id] + "."
+		active = append(active, id)
+	}
+
+	// gosnmp rejects requests with more OIDs than MaxOids, so columns are requested by groups
+	maxOids := con.MaxOids
+	if maxOids <= 0 {
+		maxOids = gosnmp.MaxOids
+	}
+	reps := con.MaxRepetitions
+
+	for len(active) > 0 {
+		done := make(map[int]bool)
+		prev := append([]string(nil), next...)
+
+		pending := active
+		for len(pending) > 0 {
+			group := pending
+			if len(group) > maxOids {
+				group = group[:maxOids]
+			}
+			query := make([]string, len(group))
+			for i, id := range group {
+				query[i] = next[id]
+			}
+
+			var result *gosnmp.SnmpPacket
+			var err error
+			if con.Version == gosnmp.Version1 {
+				result, err = con.GetNext(query)
+			} else {
+				result, err = con.GetBulk(query, 0, reps)
+			}
+			if err != nil {
+				return rows, err
+			}
+
+			switch {
+			case result.Error == gosnmp.NoError:
+			case result.Error == gosnmp.TooBig && con.Version != gosnmp.Version1 && reps > 1:
+				// response does not fit into message, group is requested again by less repetitions
+				reps /= 2
+				l.Printf(h.DEBUG, "Host %s: response is too big, walk by %d repetitions", con.Target, reps)
+				continue
+			case result.Error == gosnmp.TooBig && maxOids > 1:
+				maxOids /= 2
+				l.Printf(h.DEBUG, "Host %s: response is too big, walk by %d OIDs", con.Target, maxOids)
+				continue
+			case result.Error == gosnmp.NoSuchName && con.Version == gosnmp.Version1 &&
+				result.ErrorIndex > 0 && int(result.ErrorIndex) <= len(group):
+				// SNMPv1 agent returns error (and no values) if column is the end of MIB,
+				// column is done, rest of group is requested again
+				id := group[result.ErrorIndex-1]
+				done[id] = true
+				rest := make([]int, 0, len(pending)-1)
+				for _, p := range pending {
+					if p != id {
+						rest = append(rest, p)
+					}
+				}
+				pending = rest
+				continue
+			default:
+				return rows, fmt.Errorf("walk error %s at %d of %s", result.Error, result.ErrorIndex, strings.Join(query, " "))
+			}
+			pending = pending[len(group):]
+
+			// varbinds of GetBulk are interleaved: repetition by repetition, column by column of group
+			for i := range result.Variables {
+				pdu := result.Variables[i]
+				id := group[i%len(group)]
+				if done[id] {
+					continue
+				}
+				switch pdu.Type {
+				case gosnmp.EndOfMibView, gosnmp.NoSuchObject, gosnmp.NoSuchInstance:
+					done[id] = true
+					continue
+				}
+				if !strings.HasPrefix(pdu.Name, prefixes[id]) {
+					done[id] = true
+					continue
+				}
+
+				index := strings.TrimPrefix(pdu.Name, prefixes[id])
+				row, ok := rowByIndex[index]
+				if !ok {
+					row = &TableRow{Index: index, Values: make([]*gosnmp.SnmpPDU, len(columns))}
+					rowByIndex[index] = row
+					rows = append(rows, row)
+				}
+				row.Values[id] = &pdu
+				next[id] = pdu.Name
+			}
+		}
+
+		stillActive := active[:0]
+		for _, id := range active {
+			// stop on end of column, or if device does not move forward
+			if !done[id] && next[id] != prev[id] {
+				stillActive = append(stillActive, id)
+			}
+		}
+		active = stillActive
+	}
+
+	return rows, nil
+}
+
+//
+// SnmpValueString - return value of pdu as string, nil pdu is empty string
+//
+func SnmpValueString(pdu *gosnmp.SnmpPDU) string {
+	if pdu == nil {
+		return ""
+	}
 	switch pdu.Type {
 	case gosnmp.OctetString:
-		if _, ok := val.SetString(string(pdu.Value.([]byte))); !ok {
-			return fmt.Errorf("failed parse string responce, %s - resp: %s", pdu.Name, string(pdu.Value.([]byte)))
-		}
+		return string(pdu.Value.([]byte))
 	default:
+		return gosnmp.ToBigInt(pdu.Value).String()
+	}
+}
+
+//
+// ErrNoValue - device has no value for OID (NoSuchObject, NoSuchInstance, EndOfMibView, Null),
+// it is stored as unknown
+//
+var ErrNoValue = errors.New("no value")
+
+//
+// ParseSNMPResult - update value of givel *val, number of octet string is taken by extract
+// regexp of template (first group or whole match), e.g. `^(-?[\d.]+)\s*C$` for "23.5 C"
+//
+func ParseSNMPResult(pdu *gosnmp.SnmpPDU, template *OID, val *big.Float) error {
+	switch pdu.Type {
+	case gosnmp.Integer, gosnmp.Counter32, gosnmp.Gauge32, gosnmp.Counter64, gosnmp.Uinteger32, gosnmp.TimeTicks:
 		val.SetInt(gosnmp.ToBigInt(pdu.Value))
+	case gosnmp.OpaqueFloat:
+		val.SetFloat64(float64(pdu.Value.(float32)))
+	case gosnmp.OpaqueDouble:
+		val.SetFloat64(pdu.Value.(float64))
+	case gosnmp.IPAddress:
+		// address as number, like INET_ATON() of MySQL, buggy devices return empty address
+		if pdu.Value == nil {
+			return ErrNoValue
+		}
+		ip := net.ParseIP(fmt.Sprint(pdu.Value)).To4()
+		if ip == nil {
+			return fmt.Errorf("failed parse ip address responce, %s - resp: %v", pdu.Name, pdu.Value)
+		}
+		val.SetUint64(uint64(ip[0])<<24 | uint64(ip[1])<<16 | uint64(ip[2])<<8 | uint64(ip[3]))
+	case gosnmp.OctetString:
+		str := strings.TrimSpace(string(pdu.Value.([]byte)))
+		if template != nil && template.extract != nil {
+			match := template.extract.FindStringSubmatch(str)
+			if match == nil {
+				return fmt.Errorf("failed extract value from string responce, %s - resp: %s", pdu.Name, str)
+			}
+			str = match[0]
+			if len(match) > 1 {
+				str = match[1]
+			}
+		}
+		if _, ok := val.SetString(str); !ok {
+			return fmt.Errorf("failed parse string responce, %s - resp: %s", pdu.Name, str)
+		}
+	case gosnmp.Null, gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView:
+		return ErrNoValue
+	default:
+		return fmt.Errorf("unsupported type 0x%02x of responce, %s", byte(pdu.Type), pdu.Name)
 	}
 
 	return nil
 }
 
 //
-// RRDStoreValues - store all fetched values into RRD files
+// Series - return identity of value fetched by template for device/iface
+//
+func (v *Iface2SNMP) Series() *Series {
+	s := &Series{
+		Path:        v.snmpTemplate.path,
+		ObjectID:    v.ifaceID,
+		DeviceID:    v.device.id,
+		DeviceType:  v.device.devType,
+		IfaceID:     v.ifaceID,
+		CounterType: v.snmpTemplate.couterType,
+		Min:         v.snmpTemplate.min,
+		Max:         v.snmpTemplate.max,
+		Step:        v.snmpTemplate.step,
+	}
+	if s.ObjectID == "" {
+		s.ObjectID = v.device.id
+	}
+	return s
+}
+
+//
+// RRDStoreValues - store all fetched values into enabled sinks and check thresholds
 //
 func RRDStoreValues(snmpResp *[]*big.Float, snmpVars *[]Iface2SNMP) error {
 
@@ -129,28 +609,28 @@ func RRDStoreValues(snmpResp *[]*big.Float, snmpVars *[]Iface2SNMP) error {
 		return fmt.Errorf("parsed responce count not match requested values count")
 	}
 
-	var fileRRD, ifaceID string
 	var rrdTemplate *OID
 
 LOOP_THROUGH_VAR:
 	for id, valRRD := range *snmpResp {
-		if valRRD == nil {
-			continue LOOP_THROUGH_VAR
-		}
-
-		ifaceID = (*snmpVars)[id].ifaceID
+		series := (*snmpVars)[id].Series()
 		rrdTemplate = (*snmpVars)[id].snmpTemplate
 
-		valRRD = valRRD.Mul(valRRD, rrdTemplate.rate)
-		fileRRD = fmt.Sprintf("%s/%010s", rrdTemplate.rrdDir, ifaceID)
+		// nil is unknown value, it is stored as unknown but is not checked by thresholds
+		if valRRD != nil {
+			valRRD = valRRD.Mul(valRRD, rrdTemplate.rate)
+		}
 
-		if err := RRDUpdate(fileRRD, timeUpdRRD, fmt.Sprintf("%.0f", valRRD)); err != nil {
-			if _, err := os.Stat(fileRRD); !os.IsNotExist(err) {
-				continue LOOP_THROUGH_VAR
-			}
-			if _, err := RRDCreate(fileRRD, rrdTemplate.couterType, rrdTemplate.min, rrdTemplate.max, rrdTemplate.step); err != nil {
-				l.Printf(h.ERROR, "Can not create rrddb: %s - %s", fileRRD, err)
-			}
+		if err := sinks.Store(series, timeUpdRRD, valRRD); err != nil {
+			l.Printf(h.ERROR, "Can not store value: %s/%s - %s", series.Path, series.ObjectID, err)
+		}
+
+		if valRRD == nil {
+			continue LOOP_THROUGH_VAR
+		}
+		if len(rrdTemplate.thresholds) > 0 {
+			val, _ := valRRD.Float64()
+			CheckThresholds(series, rrdTemplate.thresholds, val, timeUpdRRD)
 		}
 	}
 
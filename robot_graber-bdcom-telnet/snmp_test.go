@@ -0,0 +1,280 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+//
+// snmpTestAgent - SNMP agent on UDP socket, serves Get/GetNext/GetBulk by sorted list of OIDs
+// with values (int or string, repetition of response if value is not set). Response with more
+// than maxVarbinds values is tooBig, errorStatus is returned for every request
+//
+type snmpTestAgent struct {
+	version     gosnmp.SnmpVersion
+	oids        []string
+	values      map[string]interface{}
+	maxVarbinds int
+	errorStatus gosnmp.SNMPError
+
+	mu       sync.Mutex
+	requests []string // <varbinds>x<max-repetitions>
+}
+
+func snmpTestOidLess(a, b string) bool {
+	pa, pb := strings.Split(strings.Trim(a, "."), "."), strings.Split(strings.Trim(b, "."), ".")
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		na, _ := strconv.Atoi(pa[i])
+		nb, _ := strconv.Atoi(pb[i])
+		if na != nb {
+			return na < nb
+		}
+	}
+	return len(pa) < len(pb)
+}
+
+//
+// start - start agent, return connection to it
+//
+func (a *snmpTestAgent) start(t *testing.T) *gosnmp.GoSNMP {
+	sort.Slice(a.oids, func(i, j int) bool { return snmpTestOidLess(a.oids[i], a.oids[j]) })
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go a.serve(conn)
+
+	con := &gosnmp.GoSNMP{
+		Target:         "127.0.0.1",
+		Port:           uint16(conn.LocalAddr().(*net.UDPAddr).Port),
+		Community:      "public",
+		Version:        a.version,
+		Timeout:        time.Second,
+		MaxOids:        2,
+		MaxRepetitions: 4,
+	}
+	if err = con.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { con.Conn.Close() })
+	return con
+}
+
+func (a *snmpTestAgent) serve(conn net.PacketConn) {
+	decoder := &gosnmp.GoSNMP{Version: a.version, Community: "public"}
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req, err := decoder.SnmpDecodePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		if req.PDUType == gosnmp.GetBulkRequest {
+			req.MaxRepetitions = snmpTestBulkReps(buf[:n])
+		}
+		resp := a.response(req)
+		if out, err := resp.MarshalMsg(); err == nil {
+			conn.WriteTo(out, addr)
+		}
+	}
+}
+
+//
+// snmpTestBulkReps - max-repetitions of GetBulk request (message: version, community,
+// PDU: request-id, non-repeaters, max-repetitions, ...), gosnmp does not decode it
+//
+func snmpTestBulkReps(packet []byte) uint32 {
+	// tlv - return value of first BER field and rest of data after it
+	tlv := func(data []byte) ([]byte, []byte) {
+		if len(data) < 2 {
+			return nil, nil
+		}
+		length, pos := int(data[1]), 2
+		if length&0x80 != 0 {
+			n := length & 0x7f
+			length, pos = 0, 2+n
+			for _, b := range data[2:pos] {
+				length = length<<8 | int(b)
+			}
+		}
+		if pos+length > len(data) {
+			return nil, nil
+		}
+		return data[pos : pos+length], data[pos+length:]
+	}
+
+	msg, _ := tlv(packet)
+	_, rest := tlv(msg)   // version
+	_, rest = tlv(rest)   // community
+	pdu, _ := tlv(rest)   // GetBulk PDU
+	_, rest = tlv(pdu)    // request-id
+	_, rest = tlv(rest)   // non-repeaters
+	value, _ := tlv(rest) // max-repetitions
+	reps := uint32(0)
+	for _, b := range value {
+		reps = reps<<8 | uint32(b)
+	}
+	return reps
+}
+
+func (a *snmpTestAgent) next(name string) (string, bool) {
+	for _, oid := range a.oids {
+		if snmpTestOidLess(name, oid) {
+			return oid, true
+		}
+	}
+	return "", false
+}
+
+func (a *snmpTestAgent) pdu(oid string, r int) gosnmp.SnmpPDU {
+	switch value := a.values[oid].(type) {
+	case int:
+		return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.Integer, Value: value}
+	case string:
+		return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.OctetString, Value: value}
+	}
+	return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.Integer, Value: r}
+}
+
+func (a *snmpTestAgent) response(req *gosnmp.SnmpPacket) *gosnmp.SnmpPacket {
+	reps := 1
+	if req.PDUType == gosnmp.GetBulkRequest {
+		reps = int(req.MaxRepetitions)
+	}
+	a.mu.Lock()
+	a.requests = append(a.requests, strconv.Itoa(len(req.Variables))+"x"+strconv.Itoa(reps))
+	a.mu.Unlock()
+
+	resp := &gosnmp.SnmpPacket{Version: req.Version, Community: req.Community, PDUType: gosnmp.GetResponse,
+		RequestID: req.RequestID, Variables: []gosnmp.SnmpPDU{}}
+	if a.errorStatus != gosnmp.NoError {
+		resp.Error, resp.ErrorIndex = a.errorStatus, 1
+		return resp
+	}
+
+	if req.PDUType == gosnmp.GetRequest {
+		for _, pdu := range req.Variables {
+			if _, ok := a.values[pdu.Name]; ok {
+				resp.Variables = append(resp.Variables, a.pdu(pdu.Name, 0))
+			} else {
+				resp.Variables = append(resp.Variables, gosnmp.SnmpPDU{Name: pdu.Name, Type: gosnmp.NoSuchObject})
+			}
+		}
+		return resp
+	}
+
+	cur := make([]string, len(req.Variables))
+	for i, pdu := range req.Variables {
+		cur[i] = pdu.Name
+	}
+	for r := 0; r < reps; r++ {
+		for i := range cur {
+			oid, ok := a.next(cur[i])
+			switch {
+			case ok:
+				cur[i] = oid
+				resp.Variables = append(resp.Variables, a.pdu(oid, r))
+			case a.version == gosnmp.Version1:
+				// SNMPv1 has no exceptions, request is returned with error
+				resp.Error, resp.ErrorIndex = gosnmp.NoSuchName, uint8(i+1)
+				resp.Variables = req.Variables
+				return resp
+			default:
+				resp.Variables = append(resp.Variables, gosnmp.SnmpPDU{Name: cur[i], Type: gosnmp.EndOfMibView})
+			}
+		}
+	}
+
+	if a.maxVarbinds > 0 && len(resp.Variables) > a.maxVarbinds {
+		resp.Error, resp.Variables = gosnmp.TooBig, []gosnmp.SnmpPDU{}
+	}
+	return resp
+}
+
+//
+// snmpTestTable - three columns of table with rows 1..5, other tables around
+//
+func snmpTestTable() []string {
+	oids := []string{".1.3.6.1.2.1.1.1.0"}
+	for col := 1; col <= 3; col++ {
+		for row := 1; row <= 5; row++ {
+			oids = append(oids, ".1.3.6.1.2.1.2.2.1."+strconv.Itoa(col)+"."+strconv.Itoa(row))
+		}
+	}
+	return oids
+}
+
+func snmpTestColumns() []string {
+	return []string{".1.3.6.1.2.1.2.2.1.1", ".1.3.6.1.2.1.2.2.1.2", ".1.3.6.1.2.1.2.2.1.3"}
+}
+
+func snmpTestCheckRows(t *testing.T, rows []*TableRow, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 5 {
+		t.Fatalf("rows: %d, expected 5", len(rows))
+	}
+	for i, row := range rows {
+		if row.Index != strconv.Itoa(i+1) {
+			t.Errorf("row %d has index %s", i, row.Index)
+		}
+		for col, pdu := range row.Values {
+			if pdu == nil || pdu.Type != gosnmp.Integer {
+				t.Errorf("row %s, column %d: %v", row.Index, col, pdu)
+			}
+		}
+	}
+}
+
+func TestWalkTable(t *testing.T) {
+	for _, version := range []gosnmp.SnmpVersion{gosnmp.Version1, gosnmp.Version2c} {
+		con := (&snmpTestAgent{version: version, oids: snmpTestTable()}).start(t)
+		rows, err := WalkTable(con, snmpTestColumns())
+		snmpTestCheckRows(t, rows, err)
+	}
+}
+
+func TestWalkTableEndOfMib(t *testing.T) {
+	// last column is the end of MIB, SNMPv1 agent returns noSuchName for it
+	oids := snmpTestTable()[1:]
+	for _, version := range []gosnmp.SnmpVersion{gosnmp.Version1, gosnmp.Version2c} {
+		con := (&snmpTestAgent{version: version, oids: oids}).start(t)
+		con.MaxOids = 3
+		rows, err := WalkTable(con, snmpTestColumns())
+		snmpTestCheckRows(t, rows, err)
+	}
+}
+
+func TestWalkTableTooBig(t *testing.T) {
+	a := &snmpTestAgent{version: gosnmp.Version2c, oids: snmpTestTable(), maxVarbinds: 1}
+	con := a.start(t)
+	rows, err := WalkTable(con, snmpTestColumns())
+	snmpTestCheckRows(t, rows, err)
+
+	// repetitions are decreased, then OIDs per request
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.requests[0] != "2x4" || a.requests[1] != "2x2" || a.requests[2] != "2x1" || a.requests[3] != "1x1" {
+		t.Errorf("requests: %v", a.requests)
+	}
+}
+
+func TestWalkTableError(t *testing.T) {
+	con := (&snmpTestAgent{version: gosnmp.Version2c, oids: snmpTestTable(), errorStatus: gosnmp.GenErr}).start(t)
+	if rows, err := WalkTable(con, snmpTestColumns()); err == nil {
+		t.Errorf("walk with error of agent returns %d rows without error", len(rows))
+	}
+}
@@ -0,0 +1 @@
+/Users/4lex/HaveFun/GoLang/robots_monitoring-scripts/lineproto_test.go
\ No newline at end of file
@@ -0,0 +1 @@
+/Users/4lex/HaveFun/GoLang/robots_monitoring-scripts/mib.go
\ No newline at end of file
@@ -11,9 +11,13 @@ import (
 )
 
 const (
-	sqlGetDevice = `SELECT d.id, d.device_type_id, INET_NTOA(d.ip) AS ip, t.snmp_version, d.community ` +
+	sqlGetDevice = `SELECT d.id, d.device_type_id, INET_NTOA(d.ip) AS ip, t.snmp_version, d.community, ` +
+		`d.snmp_user, d.snmp_auth_proto, d.snmp_auth_key, d.snmp_priv_proto, d.snmp_priv_key, ` +
+		`COALESCE(d.snmp_port, t.snmp_port) AS snmp_port, COALESCE(d.snmp_timeout, t.snmp_timeout) AS snmp_timeout, ` +
+		`COALESCE(d.snmp_retries, t.snmp_retries) AS snmp_retries, COALESCE(d.snmp_max_oids, t.snmp_max_oids) AS snmp_max_oids, ` +
+		`COALESCE(d.credential_id, t.credential_id) AS credential_id ` +
 		`FROM devices d, device_types t WHERE t.id=d.device_type_id AND d.monitor=1`
-	sqlGetSnmpTemplates = `SELECT device_type_id, CONCAT(t.shared, '/', t.name) AS path, t.query, t.rate, t.type AS couter_type, t.min, t.max, t.step, t.threshold  ` +
+	sqlGetSnmpTemplates = `SELECT device_type_id, CONCAT(t.shared, '/', t.name) AS path, t.query, t.rate, t.type AS couter_type, t.min, t.max, t.step, t.threshold, t.extract, t.expr ` +
 		`FROM snmp_templates t, device_types d, device_type_snmp_template dt WHERE d.id=dt.device_type_id AND t.id=dt.snmp_template_id`
 )
 
@@ -21,12 +25,20 @@ var snmpTemplates map[string][]*OID
 
 func process() {
 
+	if *metricsListen != "" {
+		StartExporter()
+	}
+
 	wgQueryQueue := &sync.WaitGroup{}
 	chanQuery := mysqli.InitQueryQueue(wgQueryQueue)
 
 	timeUpdRRD = time.Now()
 	l.Printf(h.DEBUG, "Time for RRD DB update fixed to: %s", timeUpdRRD.Format("2006-01-02 15:04:05"))
 
+	// raised and pending alerts and schedule of templates of previous runs
+	LoadAlertStates()
+	LoadPollSchedule()
+
 	//
 	// Select SMMP templates and prepare them for use
 	//
@@ -45,6 +57,9 @@ func process() {
 			)
 		}
 	}
+	for devType, templates := range snmpTemplates {
+		snmpTemplates[devType] = CompileExprTemplates(templates)
+	}
 
 	//
 	// Start N-workers for process all devices
@@ -61,11 +76,15 @@ func process() {
 	//
 	listDevice := mysqli.DBSelectList(sqlGetDevice)
 	for _, dev := range listDevice {
-		deviceChannel <- &Device{dev["id"], dev["device_type_id"], dev["ip"], dev["snmp_version"], dev["community"]}
+		if isStopping() {
+			break
+		}
+		deviceChannel <- NewDevice(dev)
 	}
 
 	close(deviceChannel)
 	wgDeviceQueue.Wait()
+	SavePollSchedule(timeUpdRRD)
 
 	close(chanQuery)
 	wgQueryQueue.Wait()
@@ -89,40 +108,65 @@ func grabeDevice(wg *sync.WaitGroup, num int, chanQuery chan string, deviceChann
 LOOP_PROCESS_DEVICE:
 	for dev := range deviceChannel {
 
+		// states of removed templates and threshold rules
+		ExpireAlertStates(dev.id, false, func() map[string][]*Threshold {
+			alive := make(map[string][]*Threshold)
+			for _, template := range snmpTemplates[dev.devType] {
+				alive["/"+template.path] = template.thresholds
+			}
+			return alive
+		}, timeUpdRRD)
+
 		regForNext := regexp.MustCompile(`^(.+)\.([0-9]+?)?$`)
-		from, to, oidCount = 0, 0, len(snmpTemplates[dev.devType])
+		templates, computed := SplitExprTemplates(DueTemplates(dev.id, snmpTemplates[dev.devType], timeUpdRRD))
+		from, to, oidCount = 0, 0, len(templates)
 		snmpQueries = snmpQueries[:0]
 		snmpVars = snmpVars[:0]
 		snmpResp = snmpResp[:0]
 
-		snmpInst := GetSnmpCon(dev.ip, dev.snmpVer, dev.community)
+		if oidCount == 0 && len(computed) == 0 {
+			l.Printf(h.DEBUG, "%s: host %s, no templates to poll now", funcName, dev.ip)
+			continue LOOP_PROCESS_DEVICE
+		}
+
+		snmpInst, err := dev.SnmpCon()
+		if err != nil {
+			l.Printf(h.ERROR, "%s: host %s, error: %s", funcName, dev.ip, err)
+			continue LOOP_PROCESS_DEVICE
+		}
 		if err := snmpInst.Connect(); err != nil {
 			l.Printf(h.INFO, "%s: Host %s got connect error: %v", funcName, dev.ip, err)
 			continue LOOP_PROCESS_DEVICE
 		}
 		defer snmpInst.Conn.Close()
 
-		l.Printf(h.DEBUG, "%s: host %s, devType: %s, community: %s, snmpVer: %s, oidCount: %d",
-			funcName, dev.ip, dev.devType, dev.community, dev.snmpVer, oidCount)
+		l.Printf(h.DEBUG, "%s: host %s, devType: %s, snmpVer: %s, oidCount: %d",
+			funcName, dev.ip, dev.devType, dev.snmpVer, oidCount)
 
-		for from = 0; from < oidCount; from += *snmpMaxOids {
-			if to = from + *snmpMaxOids; to > oidCount {
+		for from = 0; from < oidCount; from += dev.maxOids {
+			if to = from + dev.maxOids; to > oidCount {
 				to = oidCount
 			}
 
 			var snmpQueries []string
-			for _, template := range snmpTemplates[dev.devType][from:to] {
+			for _, template := range templates[from:to] {
 				snmpQueries = append(snmpQueries, regForNext.ReplaceAllString(template.query, "${1}"))
-				snmpVars = append(snmpVars, Iface2SNMP{ifaceID: dev.id, snmpTemplate: template})
+				snmpVars = append(snmpVars, Iface2SNMP{device: dev, snmpTemplate: template})
 			}
 
 			if result, err := snmpInst.GetNext(snmpQueries); err != nil {
 				l.Printf(h.ERROR, "%s: host %s do not responce on GET request, error: %v", funcName, dev.ip, err)
 				continue LOOP_PROCESS_DEVICE
 			} else {
-				for _, pdu := range result.Variables {
+				for i, pdu := range result.Variables {
+					if from+i >= to {
+						break
+					}
 					valRRD := new(big.Float)
-					if err = ParseSNMPResult(&pdu, valRRD); err != nil {
+					if err = ParseSNMPResult(&pdu, templates[from+i], valRRD); err == ErrNoValue {
+						l.Printf(h.DEBUG, "%s: host %s, no value of %s", funcName, dev.ip, pdu.Name)
+						valRRD = nil
+					} else if err != nil {
 						l.Printf(h.ERROR, "%s: host %s, error: %s", funcName, dev.ip, err)
 						valRRD = nil
 					}
@@ -132,6 +176,17 @@ LOOP_PROCESS_DEVICE:
 			}
 		}
 
+		// values of computed templates, unknown if any operand is not fetched
+		exprEnv := NewExprEnv(snmpInst)
+		for _, template := range computed {
+			valRRD, err := exprEnv.Eval(template.expr, "", nil)
+			if err != nil {
+				l.Printf(h.DEBUG, "%s: host %s, template %s, error: %s", funcName, dev.ip, template.path, err)
+			}
+			snmpResp = append(snmpResp, valRRD)
+			snmpVars = append(snmpVars, Iface2SNMP{device: dev, snmpTemplate: template})
+		}
+
 		if err := RRDStoreValues(&snmpResp, &snmpVars); err != nil {
 			l.Printf(h.ERROR, "%s: host %s, error: %s", funcName, dev.ip, err)
 		} else {
@@ -4,6 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"math/big"
+	"net"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,41 +19,125 @@ const (
 	oidIfDesc  = ".1.3.6.1.2.1.2.2.1.2."
 	oidIfType  = ".1.3.6.1.2.1.2.2.1.3."
 	oidIfSpeed = ".1.3.6.1.2.1.2.2.1.5."
-
-	sqlGetDeviceAll = `SELECT d.id, d.device_type_id, INET_NTOA(d.ip) AS ip, t.snmp_version, d.community ` +
+	oidIfMAC   = ".1.3.6.1.2.1.2.2.1.6."
+
+	// ifXTable
+	oidIfName      = ".1.3.6.1.2.1.31.1.1.1.1."
+	oidIfHighSpeed = ".1.3.6.1.2.1.31.1.1.1.15."
+	oidIfAlias     = ".1.3.6.1.2.1.31.1.1.1.18."
+	oidIfHCInOctet = ".1.3.6.1.2.1.31.1.1.1.6."
+
+	oidSysUpTime    = ".1.3.6.1.2.1.1.3.0"
+	oidIfAdmin      = ".1.3.6.1.2.1.2.2.1.7."
+	oidIfOper       = ".1.3.6.1.2.1.2.2.1.8."
+	oidIfLastChange = ".1.3.6.1.2.1.2.2.1.9."
+
+	// ifSpeed of ports faster than 4.2 Gbps is saturated, ifHighSpeed (Mbps) is used for them
+	ifSpeedMax = 4294967295
+
+	sqlGetDeviceAll = `SELECT d.id, d.device_type_id, INET_NTOA(d.ip) AS ip, t.snmp_version, d.community, ` +
+		`d.snmp_user, d.snmp_auth_proto, d.snmp_auth_key, d.snmp_priv_proto, d.snmp_priv_key, ` +
+		`COALESCE(d.snmp_port, t.snmp_port) AS snmp_port, COALESCE(d.snmp_timeout, t.snmp_timeout) AS snmp_timeout, ` +
+		`COALESCE(d.snmp_retries, t.snmp_retries) AS snmp_retries, COALESCE(d.snmp_max_oids, t.snmp_max_oids) AS snmp_max_oids, ` +
+		`COALESCE(d.credential_id, t.credential_id) AS credential_id ` +
 		`FROM devices d, device_types t WHERE t.id = d.device_type_id AND d.monitor = 1`
 	sqlGetDeviceByID   = sqlGetDeviceAll + ` AND d.id = ? LIMIT 1`
 	sqlGetDeviceByType = sqlGetDeviceAll + ` AND d.device_type_id IN `
 
-	sqlGetIface         = `SELECT id, oid FROM device_ifaces WHERE device_id = ? AND iface_type_id = ?`
+	sqlGetIface         = `SELECT id, oid, hc_counters, hc_polled FROM device_ifaces WHERE device_id = ? AND iface_type_id = ? AND active = 1`
+	sqlUpdateIfaceHC    = `UPDATE device_ifaces SET hc_polled = ? WHERE id = ?`
+	sqlGetActiveIfaces  = `SELECT id, iface_type_id FROM device_ifaces WHERE device_id = ? AND active = 1`
 	sqlGetSnmpTemplates = `SELECT di.device_type_id AS device_type_id, di.iface_type_id AS iface_type_id, ` +
-		`CONCAT(t.shared, '/', t.name) AS path, t.query, t.rate, t.type AS couter_type, t.min, t.max, t.step, t.threshold ` +
+		`CONCAT(t.shared, '/', t.name) AS path, t.query, t.rate, t.type AS couter_type, t.min, t.max, t.step, t.threshold, t.extract, t.expr ` +
 		`FROM device_type_iface_types di, iface_type_snmp_template p, snmp_templates t ` +
 		`WHERE di.id=p.dev_iface_type_id AND t.id=snmp_template_id`
 
-	sqlCreateDevicePort1 = `INSERT INTO device_ifaces (device_id, oid, name, speed, iface_type_id, created_at, updated_at) VALUES `
-	sqlCreateDevicePort2 = `('%s', '%s', '%s', '%s', '%s', NOW(), NOW()),`
-	sqlCreateDevicePort3 = ` ON DUPLICATE KEY UPDATE iface_type_id=VALUE(iface_type_id), speed=VALUE(speed), name=VALUE(name), updated_at=NOW()`
+	sqlCreateDevicePort1 = `INSERT INTO device_ifaces (device_id, oid, name, speed, if_type, iface_type_id, if_name, alias, high_speed, mac, hc_counters, created_at, updated_at) VALUES `
+	sqlCreateDevicePort2 = `(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())`
+	sqlCreateDevicePort3 = `ON DUPLICATE KEY UPDATE iface_type_id=VALUE(iface_type_id), speed=VALUE(speed), name=VALUE(name), if_type=VALUE(if_type), ` +
+		`if_name=VALUE(if_name), alias=VALUE(alias), high_speed=VALUE(high_speed), mac=VALUE(mac), hc_counters=VALUE(hc_counters), active=1, updated_at=NOW()`
+
+	sqlGetIfaceRules = `SELECT id, device_type_id, iface_type_id, if_type, name_regex, alias_regex, min_speed, max_speed ` +
+		`FROM iface_type_rules ORDER BY device_type_id IS NULL, priority, id`
+
+	sqlGetDeviceIfaces   = `SELECT id, oid, name, if_name, active FROM device_ifaces WHERE device_id = ?`
+	sqlMoveIfaces        = `UPDATE device_ifaces SET oid = -id WHERE id IN (%s)`
+	sqlRenumberIface     = `UPDATE device_ifaces SET oid = ?, updated_at = NOW() WHERE id = ?`
+	sqlDisableIfaces     = `UPDATE device_ifaces SET active = 0, updated_at = NOW() WHERE id IN (%s)`
+	sqlCreateIfaceEvent1 = `INSERT INTO inventory_events (device_id, iface_id, event, oid, old_oid, name, old_name, created_at) VALUES `
+	sqlCreateIfaceEvent2 = `(?, ?, ?, ?, ?, ?, ?, NOW())`
+
+	sqlGetIfaceStatus     = `SELECT id, oid, admin_status, oper_status FROM device_ifaces WHERE device_id = ? AND active = 1`
+	sqlUpdateIfaceStatus  = `UPDATE device_ifaces SET admin_status = ?, oper_status = ?, last_change = ? WHERE id = ?`
+	sqlCreateStatusEvent1 = `INSERT INTO iface_events (device_id, iface_id, admin_status, oper_status, old_admin_status, old_oper_status, ` +
+		`last_change, changed_at, created_at) VALUES `
+	sqlCreateStatusEvent2 = `(?, ?, ?, ?, ?, ?, ?, ?, NOW())`
 )
 
 var (
 	deviceID     = flag.Int("device", 0, "Device ID to update interface list")
 	isFetchIface = flag.Bool("fetch-iface", false, "Fetch all interface from device and store it in DB")
 	isFetchData  = flag.Bool("fetch-data", false, "Fetch data from interface and store it in DB")
+	fetchStatus  = flag.Bool("fetch-status", true, "Poll admin/oper status of ifaces with fetch data")
+	ifaceDown    = flag.String("iface-down-threshold", ">0/2@warning", "Threshold of alert for iface which is admin up and oper down, empty - no alerts")
 
 	snmpTemplates map[string]map[string][]*OID
+
+	// thresholds for value 1 of iface which is admin up and oper down, 0 otherwise
+	ifaceDownThresholds []*Threshold
+
+	// rules for classify ifaces by device type, "" - rules for all device types
+	ifaceRules map[string][]*ifaceRule
+
+	// 32-bit counters of ifTable/ifXTable and their 64-bit equivalents of ifXTable
+	ifHCCounters = map[string]string{
+		"1.3.6.1.2.1.2.2.1.10":   ".1.3.6.1.2.1.31.1.1.1.6",  // ifInOctets -> ifHCInOctets
+		"1.3.6.1.2.1.2.2.1.11":   ".1.3.6.1.2.1.31.1.1.1.7",  // ifInUcastPkts -> ifHCInUcastPkts
+		"1.3.6.1.2.1.31.1.1.1.2": ".1.3.6.1.2.1.31.1.1.1.8",  // ifInMulticastPkts -> ifHCInMulticastPkts
+		"1.3.6.1.2.1.31.1.1.1.3": ".1.3.6.1.2.1.31.1.1.1.9",  // ifInBroadcastPkts -> ifHCInBroadcastPkts
+		"1.3.6.1.2.1.2.2.1.16":   ".1.3.6.1.2.1.31.1.1.1.10", // ifOutOctets -> ifHCOutOctets
+		"1.3.6.1.2.1.2.2.1.17":   ".1.3.6.1.2.1.31.1.1.1.11", // ifOutUcastPkts -> ifHCOutUcastPkts
+		"1.3.6.1.2.1.31.1.1.1.4": ".1.3.6.1.2.1.31.1.1.1.12", // ifOutMulticastPkts -> ifHCOutMulticastPkts
+		"1.3.6.1.2.1.31.1.1.1.5": ".1.3.6.1.2.1.31.1.1.1.13", // ifOutBroadcastPkts -> ifHCOutBroadcastPkts
+	}
 )
 
+//
+// ifaceRule struct for store rule of iface classification, empty fields match any iface
+//
+type ifaceRule struct {
+	id        string
+	ifaceType string
+	ifType    string
+	name      *regexp.Regexp // ifName or ifDescr
+	alias     *regexp.Regexp
+	minSpeed  uint64
+	maxSpeed  uint64
+}
+
+//
+// foundIface struct for store iface found on device, used for match it with ones stored in DB
+//
+type foundIface struct {
+	oid    string
+	name   string
+	ifName string
+}
+
 func process() {
 	wgQueryQueue := &sync.WaitGroup{}
 	chanQuery := mysqli.InitQueryQueue(wgQueryQueue)
 
+	if *metricsListen != "" {
+		StartExporter()
+	}
+
 	if isFlagPassed("fetch-iface") {
 		l.Printf(h.INFO, "Fetch all interface from device and store it in DB")
 		fetchIface(chanQuery)
 	}
 
-	if isFlagPassed("fetch-data") {
+	if isFlagPassed("fetch-data") || *metricsListen != "" {
 		l.Printf(h.INFO, "Fetch data from interface and store it in DB")
 		fetchInfo(chanQuery)
 	}
@@ -59,11 +146,13 @@ func process() {
 	wgQueryQueue.Wait()
 }
 
-func fetchIface(chanQuery chan string) {
+func fetchIface(chanQuery chan h.Query) {
 	funcName := "fetchIface"
 	start := time.Now().Unix()
 	l.Printf(h.FUNC, "Start: %s", funcName)
 
+	LoadIfaceRules()
+
 	//
 	// Start N-workers for process all devices
 	//
@@ -87,74 +176,103 @@ func fetchIface(chanQuery chan string) {
 	}
 
 	for _, dev := range listDevice {
-		deviceChannel <- &Device{dev["id"], dev["device_type_id"], dev["ip"], dev["snmp_version"], dev["community"]}
+		if isStopping() {
+			break
+		}
+		deviceChannel <- NewDevice(dev)
 	}
 
 	close(deviceChannel)
 	wgDeviceQueue.Wait()
+	SavePollSchedule(timeUpdRRD)
 
 	l.Printf(h.FUNC, "Stop: %s - %d, diration: %d", funcName, time.Now().Unix(), time.Now().Unix()-start)
 }
 
-func queueGrabeIfaces(wg *sync.WaitGroup, num int, chanStoreIface chan string, deviceChannel chan *Device) {
+func queueGrabeIfaces(wg *sync.WaitGroup, num int, chanStoreIface chan h.Query, deviceChannel chan *Device) {
 	defer wg.Done()
 	funcName := fmt.Sprintf("grabeIfaces[%d]", num)
 	start := time.Now().Unix()
 	l.Printf(h.FUNC, "Start: %s", funcName)
 
-	portInfo := make([]interface{}, 0, 16)
-	snmpQuery := make([]string, 0)
 	for dev := range deviceChannel {
 
-		var err error
-		var snmpResult *gosnmp.SnmpPacket
-		snmpQuery = []string{
-			strings.TrimRight(oidIfDesc, "."),
-			strings.TrimRight(oidIfSpeed, "."),
-			strings.TrimRight(oidIfType, "."),
+		snmpInst, err := dev.SnmpCon()
+		if err != nil {
+			l.Printf(h.ERROR, "%s: host %s, error: %s", funcName, dev.ip, err)
+			continue
 		}
-
-		snmpInst := GetSnmpCon(dev.ip, dev.snmpVer, dev.community)
 		if err := snmpInst.Connect(); err != nil {
 			l.Printf(h.INFO, "%s: Host %s got connect error: %v", funcName, dev.ip, err)
 			continue
 		}
 		defer snmpInst.Conn.Close()
 
-		for {
-			if snmpResult, err = snmpInst.GetNext(snmpQuery); err != nil || len(snmpResult.Variables) != 3 || !strings.HasPrefix(snmpResult.Variables[0].Name, oidIfDesc) {
-				break
+		rows, err := WalkTable(snmpInst, []string{oidIfDesc, oidIfSpeed, oidIfType, oidIfName, oidIfAlias, oidIfHighSpeed, oidIfMAC, oidIfHCInOctet})
+		if err != nil {
+			l.Printf(h.INFO, "%s: Host %s got walk error: %v", funcName, dev.ip, err)
+		}
+		complete := err == nil
+
+		ports := NewBatchInsert(sqlCreateDevicePort1, sqlCreateDevicePort2, sqlCreateDevicePort3)
+		found := make([]*foundIface, 0, len(rows))
+		for _, row := range rows {
+			// ifXTable columns are optional, old devices have no them
+			if row.Values[0] == nil || row.Values[1] == nil || row.Values[2] == nil {
+				continue
 			}
-			portInfo = append(portInfo, dev.id)
-			portInfo = append(portInfo, strings.TrimPrefix(snmpResult.Variables[0].Name, oidIfDesc))
-			for id, snmpPDU := range snmpResult.Variables {
-				snmpQuery[id] = snmpPDU.Name
-				switch snmpPDU.Type {
-				case gosnmp.OctetString:
-					portInfo = append(portInfo, string(snmpPDU.Value.([]byte)))
-					l.Printf(h.DEBUG, "Found new iface: %s", string(snmpPDU.Value.([]byte)))
-				default:
-					portInfo = append(portInfo, gosnmp.ToBigInt(snmpPDU.Value).String())
-				}
+
+			speed, _ := strconv.ParseUint(SnmpValueString(row.Values[1]), 10, 64)
+			highSpeed, _ := strconv.ParseUint(SnmpValueString(row.Values[5]), 10, 64)
+			if speed >= ifSpeedMax && highSpeed > 0 {
+				speed = highSpeed * 1000000
+			}
+
+			mac := ""
+			if row.Values[6] != nil && len(SnmpValueString(row.Values[6])) > 0 {
+				mac = net.HardwareAddr(SnmpValueString(row.Values[6])).String()
+			}
+
+			// 64-bit counters are used if iface has them, SNMPv1 has no Counter64 at all
+			hcCounters := "0"
+			if dev.snmpVer != "v1" && row.Values[7] != nil && row.Values[7].Type == gosnmp.Counter64 {
+				hcCounters = "1"
 			}
+
+			ifaceType := ClassifyIface(dev.devType, SnmpValueString(row.Values[2]), SnmpValueString(row.Values[0]),
+				SnmpValueString(row.Values[3]), SnmpValueString(row.Values[4]), speed)
+
+			ports.Add(dev.id, row.Index,
+				SnmpValueString(row.Values[0]),
+				strconv.FormatUint(speed, 10),
+				SnmpValueString(row.Values[2]),
+				ifaceType,
+				SnmpValueString(row.Values[3]),
+				SnmpValueString(row.Values[4]),
+				strconv.FormatUint(highSpeed, 10),
+				mac,
+				hcCounters)
+			found = append(found, &foundIface{oid: row.Index, name: SnmpValueString(row.Values[0]), ifName: SnmpValueString(row.Values[3])})
+			l.Printf(h.DEBUG, "Found new iface: %s (%s) %s", SnmpValueString(row.Values[0]), SnmpValueString(row.Values[3]), SnmpValueString(row.Values[4]))
 		}
 
-		if len(portInfo) == 0 {
+		if ports.Len() == 0 {
 			l.Printf(h.INFO, "%s: Host %s got emprty responce", funcName, dev.ip)
 			continue
 		}
 
-		chanStoreIface <- sqlCreateDevicePort1 +
-			strings.TrimRight(fmt.Sprintf(strings.Repeat(sqlCreateDevicePort2, len(portInfo)/5), portInfo...), ",") +
-			sqlCreateDevicePort3
+		// renumbered ifaces are moved and vanished ones are disabled before store found ones
+		for _, query := range trackIfaces(dev, found, complete) {
+			chanStoreIface <- query
+		}
 
-		portInfo = portInfo[:0]
+		ports.Send(chanStoreIface)
 	}
 
 	l.Printf(h.FUNC, "Stop: %s - %d, diration: %d", funcName, time.Now().Unix(), time.Now().Unix()-start)
 }
 
-func fetchInfo(chanQuery chan string) {
+func fetchInfo(chanQuery chan h.Query) {
 	funcName := "fetchInfo"
 	start := time.Now().Unix()
 	l.Printf(h.FUNC, "Start: %s", funcName)
@@ -162,6 +280,15 @@ func fetchInfo(chanQuery chan string) {
 	timeUpdRRD = time.Now()
 	l.Printf(h.DEBUG, "Time for RRD DB update fixed to: %s", timeUpdRRD.Format("2006-01-02 15:04:05"))
 
+	// raised and pending alerts and schedule of templates of previous runs
+	LoadAlertStates()
+	LoadPollSchedule()
+
+	var err error
+	if ifaceDownThresholds, err = ParseThresholds(*ifaceDown); err != nil {
+		l.Printf(h.ERROR, "Bad iface down threshold: %s", err)
+	}
+
 	//
 	// Select SMMP templates and prepare them for use
 	//
@@ -186,6 +313,11 @@ func fetchInfo(chanQuery chan string) {
 			)
 		}
 	}
+	for _, ifaceTemplates := range snmpTemplates {
+		for ifType, templates := range ifaceTemplates {
+			ifaceTemplates[ifType] = CompileExprTemplates(templates)
+		}
+	}
 
 	//
 	// Start N-workers for process all devices
@@ -214,7 +346,10 @@ func fetchInfo(chanQuery chan string) {
 	}
 
 	for _, dev := range listDevice {
-		deviceChannel <- &Device{dev["id"], dev["device_type_id"], dev["ip"], dev["snmp_version"], dev["community"]}
+		if isStopping() {
+			break
+		}
+		deviceChannel <- NewDevice(dev)
 	}
 
 	close(deviceChannel)
@@ -223,7 +358,7 @@ func fetchInfo(chanQuery chan string) {
 	l.Printf(h.FUNC, "Stop: %s - %d, diration: %d", funcName, time.Now().Unix(), time.Now().Unix()-start)
 }
 
-func queueGrabeIfacesData(wg *sync.WaitGroup, num int, chanStoreIface chan string, deviceChannel chan *Device) {
+func queueGrabeIfacesData(wg *sync.WaitGroup, num int, chanStoreIface chan h.Query, deviceChannel chan *Device) {
 	defer wg.Done()
 	funcName := fmt.Sprintf("queueGrabeIfacesData[%d]", num)
 	start := time.Now().Unix()
@@ -242,10 +377,26 @@ LOOP_PROCESS_DEVICE:
 		snmpVars = snmpVars[:0]
 		snmpResp = snmpResp[:0]
 
+		// states of removed templates and threshold rules, of deactivated ifaces
+		ExpireAlertStates(dev.id, true, func() map[string][]*Threshold {
+			alive := make(map[string][]*Threshold)
+			for _, iface := range mysqli.DBSelectList(sqlGetActiveIfaces, dev.id) {
+				for _, template := range snmpTemplates[dev.devType][iface["iface_type_id"]] {
+					alive[iface["id"]+"/"+template.path] = template.thresholds
+				}
+				alive[iface["id"]+"/iface/down"] = ifaceDownThresholds
+			}
+			return alive
+		}, timeUpdRRD)
+
 		//
 		// connect to device via snmp
 		//
-		snmpInst := GetSnmpCon(dev.ip, dev.snmpVer, dev.community)
+		snmpInst, err := dev.SnmpCon()
+		if err != nil {
+			l.Printf(h.ERROR, "%s: host %s, error: %s", funcName, dev.ip, err)
+			continue LOOP_PROCESS_DEVICE
+		}
 		if err := snmpInst.Connect(); err != nil {
 			l.Printf(h.INFO, "%s: Host %s got connect error: %v", funcName, dev.ip, err)
 			continue LOOP_PROCESS_DEVICE
@@ -253,13 +404,42 @@ LOOP_PROCESS_DEVICE:
 		defer snmpInst.Conn.Close()
 
 		//
-		// build SNMP Templates list fot fetch from device
+		// build SNMP Templates list fot fetch from device, computed templates are evaluated after
 		//
+		computed := make([]Iface2SNMP, 0)
+		computedIndex := make([]string, 0)
+		computedReplace := make([]map[string]string, 0)
+		resetVars := make([]int, 0)
 		for ifType, snmpTemplatePerDevice := range snmpTemplates[dev.devType] {
+			if snmpTemplatePerDevice = DueTemplates(dev.id+"/"+ifType, snmpTemplatePerDevice, timeUpdRRD); len(snmpTemplatePerDevice) == 0 {
+				continue
+			}
 			for _, iface := range mysqli.DBSelectList(sqlGetIface, dev.id, ifType) {
+				// counter of other variant (32/64-bit) is not continuation of stored one
+				hc := ifaceHC(dev, iface)
+				variantChanged := iface["hc_polled"] != hc
+				if variantChanged {
+					l.Printf(h.INFO, "%s: host %s, iface %s: HC counters %s -> %s, counters are reset", funcName, dev.ip, iface["id"], iface["hc_polled"], hc)
+					chanStoreIface <- h.Query{Query: sqlUpdateIfaceHC, Args: []interface{}{hc, iface["id"]}}
+				}
+				// operands of computed templates are replaced by 64-bit counters like queries
+				var replace map[string]string
+				if hc == "1" {
+					replace = ifHCCounters
+				}
+
 				for _, template := range snmpTemplatePerDevice {
-					snmpQueries = append(snmpQueries, fmt.Sprintf("%s.%s", template.query, iface["oid"]))
-					snmpVars = append(snmpVars, Iface2SNMP{ifaceID: iface["id"], snmpTemplate: template})
+					if template.expr != nil {
+						computed = append(computed, Iface2SNMP{ifaceID: iface["id"], device: dev, snmpTemplate: template})
+						computedIndex = append(computedIndex, iface["oid"])
+						computedReplace = append(computedReplace, replace)
+						continue
+					}
+					if _, ok := ifHCCounters[strings.Trim(template.query, ".")]; ok && variantChanged {
+						resetVars = append(resetVars, len(snmpVars))
+					}
+					snmpQueries = append(snmpQueries, ifaceQuery(dev, iface, template))
+					snmpVars = append(snmpVars, Iface2SNMP{ifaceID: iface["id"], device: dev, snmpTemplate: template})
 				}
 			}
 		}
@@ -267,33 +447,320 @@ LOOP_PROCESS_DEVICE:
 		//
 		// fetch data from device (max queries per request)
 		//
-	LOOP_PROCESS_IFACE:
-		for from = 0; from < len(snmpQueries); from += *snmpMaxOids {
+		// every requested value gets response (nil - unknown), so responses match snmpVars
+		for from = 0; from < len(snmpQueries); from += dev.maxOids {
 
-			if to = from + *snmpMaxOids; to > len(snmpQueries) {
+			if to = from + dev.maxOids; to > len(snmpQueries) {
 				to = len(snmpQueries)
 			}
 
 			result, err := snmpInst.Get(snmpQueries[from:to])
 			if err != nil {
 				l.Printf(h.ERROR, "%s: host %s got emprty responce, error: %s", funcName, dev.ip, err)
-				break LOOP_PROCESS_IFACE
+				for i := from; i < to; i++ {
+					snmpResp = append(snmpResp, nil)
+				}
+				continue
 			}
 
-			for _, pdu := range result.Variables {
+			for i := from; i < to; i++ {
+				if i-from >= len(result.Variables) {
+					snmpResp = append(snmpResp, nil)
+					continue
+				}
+				pdu := result.Variables[i-from]
 				valRRD := new(big.Float)
-				if err = ParseSNMPResult(&pdu, valRRD); err != nil {
+				if err = ParseSNMPResult(&pdu, snmpVars[i].snmpTemplate, valRRD); err == ErrNoValue {
+					l.Printf(h.DEBUG, "%s: host %s, no value of %s", funcName, dev.ip, pdu.Name)
+					valRRD = nil
+				} else if err != nil {
 					l.Printf(h.ERROR, "%s: host %s, error: %s", funcName, dev.ip, err)
-					continue LOOP_PROCESS_IFACE
+					valRRD = nil
 				}
 				snmpResp = append(snmpResp, valRRD)
 			}
 		}
 
+		// unknown value resets last counter in RRD, so next value of new variant does not make spike
+		for _, i := range resetVars {
+			snmpResp[i] = nil
+		}
+
+		// values of computed templates, unknown if any operand is not fetched
+		exprEnv := NewExprEnv(snmpInst)
+		for i, vars := range computed {
+			valRRD, err := exprEnv.Eval(vars.snmpTemplate.expr, computedIndex[i], computedReplace[i])
+			if err != nil {
+				l.Printf(h.DEBUG, "%s: host %s, iface %s, template %s, error: %s", funcName, dev.ip, vars.ifaceID, vars.snmpTemplate.path, err)
+			}
+			snmpResp = append(snmpResp, valRRD)
+			snmpVars = append(snmpVars, vars)
+		}
+
 		if err := RRDStoreValues(&snmpResp, &snmpVars); err != nil {
 			l.Printf(h.ERROR, "%s: host %s, error: %s", funcName, dev.ip, err)
 		}
+
+		if *fetchStatus {
+			for _, query := range pollIfaceStatus(dev, snmpInst) {
+				chanStoreIface <- query
+			}
+		}
 	}
 
 	l.Printf(h.FUNC, "Stop: %s - %d, diration: %d", funcName, time.Now().Unix(), time.Now().Unix()-start)
 }
+
+//
+// LoadIfaceRules - load rules for classify ifaces, rules with bad regexp are skipped
+//
+func LoadIfaceRules() {
+	ifaceRules = make(map[string][]*ifaceRule)
+
+LOOP_RULES:
+	for _, row := range mysqli.DBSelectList(sqlGetIfaceRules) {
+		rule := &ifaceRule{id: row["id"], ifaceType: row["iface_type_id"], ifType: row["if_type"]}
+		rule.minSpeed, _ = strconv.ParseUint(row["min_speed"], 10, 64)
+		rule.maxSpeed, _ = strconv.ParseUint(row["max_speed"], 10, 64)
+
+		for _, re := range []struct {
+			dst  **regexp.Regexp
+			expr string
+		}{{&rule.name, row["name_regex"]}, {&rule.alias, row["alias_regex"]}} {
+			if re.expr == "" {
+				continue
+			}
+			var err error
+			if *re.dst, err = regexp.Compile(re.expr); err != nil {
+				l.Printf(h.ERROR, "Iface rule %s has bad regexp: %s", rule.id, err)
+				continue LOOP_RULES
+			}
+		}
+
+		ifaceRules[row["device_type_id"]] = append(ifaceRules[row["device_type_id"]], rule)
+	}
+}
+
+//
+// ClassifyIface - return iface_type_id of first matched rule of device type (then of rules for all types),
+// "0" if no one rule is matched, raw ifType if there are no rules for device type at all
+//
+func ClassifyIface(devType, ifType, descr, ifName, alias string, speed uint64) string {
+	rules := make([]*ifaceRule, 0, len(ifaceRules[devType])+len(ifaceRules[""]))
+	rules = append(append(rules, ifaceRules[devType]...), ifaceRules[""]...)
+	if len(rules) == 0 {
+		return ifType
+	}
+
+	for _, rule := range rules {
+		if (rule.ifType == "" || rule.ifType == ifType) &&
+			(rule.name == nil || rule.name.MatchString(ifName) || rule.name.MatchString(descr)) &&
+			(rule.alias == nil || rule.alias.MatchString(alias)) &&
+			(rule.minSpeed == 0 || speed >= rule.minSpeed) &&
+			(rule.maxSpeed == 0 || speed <= rule.maxSpeed) {
+			return rule.ifaceType
+		}
+	}
+
+	return "0"
+}
+
+//
+// trackIfaces - match found ifaces with stored ones by ifName/ifDescr, then by ifIndex,
+// return queries for renumber matched ifaces, disable vanished ones (only if list of found
+// ifaces is complete) and store inventory events
+//
+func trackIfaces(dev *Device, found []*foundIface, complete bool) []h.Query {
+	byOid := make(map[string]map[string]string)
+	byIfName := make(map[string]map[string]string)
+	byName := make(map[string]map[string]string)
+
+	known := mysqli.DBSelectList(sqlGetDeviceIfaces, dev.id)
+	for _, iface := range known {
+		byOid[iface["oid"]] = iface
+		for _, names := range []struct {
+			m   map[string]map[string]string
+			key string
+		}{{byIfName, iface["if_name"]}, {byName, iface["name"]}} {
+			if names.key == "" {
+				continue
+			}
+			// several ifaces with the same name can not be matched by name
+			if _, ok := names.m[names.key]; ok {
+				names.m[names.key] = nil
+			} else {
+				names.m[names.key] = iface
+			}
+		}
+	}
+
+	matched := make(map[*foundIface]map[string]string)
+	used := make(map[string]bool)
+	foundOids := make(map[string]bool)
+
+	// first match by names, ifIndex can be changed after reboot
+	for _, f := range found {
+		foundOids[f.oid] = true
+		iface := byIfName[f.ifName]
+		if iface == nil {
+			iface = byName[f.name]
+		}
+		if iface != nil && !used[iface["id"]] {
+			matched[f], used[iface["id"]] = iface, true
+		}
+	}
+	// then by ifIndex, name of iface can be changed
+	for _, f := range found {
+		if iface, ok := byOid[f.oid]; ok && matched[f] == nil && !used[iface["id"]] {
+			matched[f], used[iface["id"]] = iface, true
+		}
+	}
+
+	queries := make([]h.Query, 0)
+	moved := make([]interface{}, 0)
+	disabled := make([]interface{}, 0)
+	events := NewBatchInsert(sqlCreateIfaceEvent1, sqlCreateIfaceEvent2, "")
+	addEvent := func(ifaceID, event, oid, oldOid, name, oldName string) {
+		l.Printf(h.INFO, "Device %s, iface %s: %s, oid: %s -> %s, name: %s -> %s", dev.id, ifaceID, event, oldOid, oid, oldName, name)
+		var id interface{}
+		if ifaceID != "" {
+			id = ifaceID
+		}
+		events.Add(dev.id, id, event, oid, oldOid, name, oldName)
+	}
+
+	for _, f := range found {
+		iface := matched[f]
+		switch {
+		case iface == nil:
+			addEvent("", "added", f.oid, "", f.name, "")
+		case iface["oid"] != f.oid:
+			moved = append(moved, iface["id"])
+			queries = append(queries, h.Query{Query: sqlRenumberIface, Args: []interface{}{f.oid, iface["id"]}})
+			addEvent(iface["id"], "renumbered", f.oid, iface["oid"], f.name, iface["name"])
+		case iface["active"] == "0":
+			addEvent(iface["id"], "restored", f.oid, iface["oid"], f.name, iface["name"])
+		case iface["name"] != f.name || (iface["if_name"] != "" && iface["if_name"] != f.ifName):
+			addEvent(iface["id"], "renamed", f.oid, iface["oid"], f.name, iface["name"])
+		}
+	}
+
+	for _, iface := range known {
+		if used[iface["id"]] {
+			continue
+		}
+		// vanished iface frees its ifIndex for renumbered or new one
+		if foundOids[iface["oid"]] {
+			moved = append(moved, iface["id"])
+		} else if !complete {
+			continue
+		}
+		if iface["active"] == "1" {
+			disabled = append(disabled, iface["id"])
+			addEvent(iface["id"], "removed", "", iface["oid"], "", iface["name"])
+		}
+	}
+
+	if len(moved) > 0 {
+		queries = append([]h.Query{{Query: fmt.Sprintf(sqlMoveIfaces, SQLIn(len(moved))), Args: moved}}, queries...)
+	}
+	if len(disabled) > 0 {
+		queries = append(queries, h.Query{Query: fmt.Sprintf(sqlDisableIfaces, SQLIn(len(disabled))), Args: disabled})
+	}
+
+	return append(queries, events.Queries()...)
+}
+
+//
+// pollIfaceStatus - fetch admin/oper status of ifaces, return queries for store changed ones
+// with events, check iface down thresholds
+//
+func pollIfaceStatus(dev *Device, snmpInst *gosnmp.GoSNMP) []h.Query {
+	result, err := snmpInst.Get([]string{oidSysUpTime})
+	if err != nil || len(result.Variables) == 0 {
+		l.Printf(h.INFO, "Host %s do not responce sysUpTime, error: %v", dev.ip, err)
+		return nil
+	}
+	now := time.Now()
+	upTime := gosnmp.ToBigInt(result.Variables[0].Value).Int64()
+
+	rows, err := WalkTable(snmpInst, []string{oidIfAdmin, oidIfOper, oidIfLastChange})
+	if err != nil {
+		l.Printf(h.INFO, "Host %s got walk error: %v", dev.ip, err)
+	}
+	status := make(map[string]*TableRow, len(rows))
+	for _, row := range rows {
+		if row.Values[0] != nil && row.Values[1] != nil {
+			status[row.Index] = row
+		}
+	}
+
+	queries := make([]h.Query, 0)
+	events := NewBatchInsert(sqlCreateStatusEvent1, sqlCreateStatusEvent2, "")
+	for _, iface := range mysqli.DBSelectList(sqlGetIfaceStatus, dev.id) {
+		row, ok := status[iface["oid"]]
+		if !ok {
+			continue
+		}
+		admin, oper := SnmpValueString(row.Values[0]), SnmpValueString(row.Values[1])
+
+		// ifLastChange is sysUpTime (1/100 sec) of last change, it is stored as NULL if device does not return it
+		changedAt := now
+		var lastChange interface{}
+		if row.Values[2] != nil {
+			if ticks, err := strconv.ParseInt(SnmpValueString(row.Values[2]), 10, 64); err == nil {
+				lastChange = ticks
+				if ticks <= upTime {
+					changedAt = now.Add(-time.Duration(upTime-ticks) * 10 * time.Millisecond)
+				}
+			}
+		}
+
+		if admin != iface["admin_status"] || oper != iface["oper_status"] {
+			queries = append(queries, h.Query{Query: sqlUpdateIfaceStatus, Args: []interface{}{admin, oper, lastChange, iface["id"]}})
+
+			// first poll of iface only stores its status
+			if iface["admin_status"] != "" {
+				l.Printf(h.INFO, "Device %s, iface %s: admin %s -> %s, oper %s -> %s", dev.id, iface["id"],
+					iface["admin_status"], admin, iface["oper_status"], oper)
+				events.Add(dev.id, iface["id"], admin, oper, iface["admin_status"], iface["oper_status"],
+					lastChange, changedAt.Format("2006-01-02 15:04:05"))
+			}
+		}
+
+		if len(ifaceDownThresholds) > 0 {
+			down := 0.0
+			if admin == "1" && oper != "1" {
+				down = 1
+			}
+			series := &Series{Path: "iface/down", ObjectID: iface["id"], DeviceID: dev.id, DeviceType: dev.devType, IfaceID: iface["id"]}
+			CheckThresholds(series, ifaceDownThresholds, down, now)
+		}
+	}
+
+	return append(queries, events.Queries()...)
+}
+
+//
+// ifaceHC - return "1" if 64-bit counters are polled for iface (hc_counters is found by -fetch-iface)
+//
+func ifaceHC(dev *Device, iface map[string]string) string {
+	if dev.snmpVer != "v1" && iface["hc_counters"] == "1" {
+		return "1"
+	}
+	return "0"
+}
+
+//
+// ifaceQuery - return OID of template for iface, 32-bit counter is replaced by 64-bit one
+// if iface has HC counters
+//
+func ifaceQuery(dev *Device, iface map[string]string, template *OID) string {
+	query := template.query
+	if ifaceHC(dev, iface) == "1" {
+		if hc, ok := ifHCCounters[strings.Trim(query, ".")]; ok {
+			query = hc
+		}
+	}
+	return fmt.Sprintf("%s.%s", query, iface["oid"])
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net"
 	"regexp"
-	"strings"
 	"sync"
 	"time"
 
@@ -13,13 +13,12 @@ import (
 )
 
 const (
-	sqlGetMtPassword = `SELECT GROUP_CONCAT(password SEPARATOR ';') AS passwords FROM ` +
-		`(SELECT password, COUNT(*) AS size FROM devices WHERE device_type_id = 3 GROUP BY password ORDER BY size DESC) AS t`
-	sqlGetMtList = `SELECT INET_NTOA(d.ip) AS ip, d.username, d.password, i.id AS iface_id, i.name AS if_name, ` +
-		`i.radio_name, i.mode FROM devices d, mt_ifaces i WHERE d.id = i.device_id` // AND b.id IN (1159, 1171)`
+	sqlGetMtList = `SELECT INET_NTOA(d.ip) AS ip, COALESCE(d.credential_id, t.credential_id) AS credential_id, ` +
+		`i.id AS iface_id, i.name AS if_name, i.radio_name, i.mode ` +
+		`FROM devices d, device_types t, mt_ifaces i WHERE d.id = i.device_id AND t.id = d.device_type_id` // AND b.id IN (1159, 1171)`
 
 	sqlCreateMTLink1 = "INSERT INTO mt_links (mt_iface1_id, mt_iface2_id, s1, s1_ch0, s1_ch1, ccq1, rate1, prev_byte1, s2, s2_ch0, s2_ch1, ccq2, rate2, prev_byte2, created_at, updated_at) VALUES "
-	sqlCreateMTLink2 = "('%s', '%s', '%s', '%s', '%s', '%s', '%s', '%s', '%s', '%s', '%s', '%s', '%s', '%s', NOW(), NOW()), "
+	sqlCreateMTLink2 = "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())"
 	sqlCreateMTLink3 = "ON DUPLICATE KEY UPDATE " +
 		"s1 = VALUE(s1), s1_ch0 = VALUE(s1_ch0), s1_ch1 = VALUE(s1_ch1), ccq1 = VALUE(ccq1), rate1 = VALUE(rate1), " +
 		"diff_byte1 = IF(VALUE(prev_byte1) > prev_byte1, VALUE(prev_byte1) - prev_byte1, 0), prev_byte1 = VALUE(prev_byte1), " +
@@ -28,23 +27,22 @@ const (
 		"updated_at = NOW()"
 
 	sqlCreateMtBoard1 = "INSERT INTO mt_new_boards (name, last_ip, created_at, updated_at) VALUES "
-	sqlCreateMtBoard2 = "('%s', INET_ATON('%s'), NOW(), NOW()), "
+	sqlCreateMtBoard2 = "(?, INET_ATON(?), NOW(), NOW())"
 	sqlCreateMtBoard3 = "ON DUPLICATE KEY UPDATE  name = VALUE(name), last_ip = VALUE(last_ip), updated_at=NOW()"
 )
 
 var (
-	mtPassList  []string
+	mtCredential = flag.String("credential", "mikrotik", "Name of credential profile for MT without credential_id of device and device type")
+
 	mtIfaceList map[string]map[string]string
 
 	initMtChannel chan string
-	chanQuery     chan string
+	chanQuery     chan h.Query
 
 	reRate, reTxByte, reRxByte, signalStrength *regexp.Regexp
 )
 
 func init() {
-	mtIfaceList = make(map[string]map[string]string)
-
 	//
 	// Init RegExp
 	//
@@ -61,15 +59,11 @@ func process() {
 	chanQuery := mysqli.InitQueryQueue(wgQueryQueue)
 
 	//
-	// Select passwords and wireless ifaces from DB
+	// Select wireless ifaces from DB
 	//
 
-	row := mysqli.DBSelectRow(sqlGetMtPassword)
-	if _, ok := row["passwords"]; !ok {
-		l.Printf(h.ERROR, "Can not find MT password list")
-	}
-
 	// pick all wlan ifaces
+	mtIfaceList = make(map[string]map[string]string)
 	list := mysqli.DBSelectList(sqlGetMtList)
 	for _, iface := range list {
 		mtIfaceList[iface["radio_name"]] = iface
@@ -85,6 +79,9 @@ func process() {
 
 	// pick data from MT and store it in DB
 	for _, iface := range mtIfaceList {
+		if isStopping() {
+			break
+		}
 		if iface["mode"] == "ap-bridge" || iface["mode"] == "bridge" {
 			mtChannel <- iface["radio_name"]
 		}
@@ -97,7 +94,7 @@ func process() {
 	wgQueryQueue.Wait()
 }
 
-func grabeMTQueue(wg *sync.WaitGroup, num int, chanQuery chan string, mtChannel chan string) {
+func grabeMTQueue(wg *sync.WaitGroup, num int, chanQuery chan h.Query, mtChannel chan string) {
 	defer wg.Done()
 
 	funcName := fmt.Sprintf("grabeMTQueue[%d]", num)
@@ -106,13 +103,22 @@ func grabeMTQueue(wg *sync.WaitGroup, num int, chanQuery chan string, mtChannel
 
 	var c *routeros.Client
 	var err error
-	var newMtLinks, newMtBoards string
 
 	for mtRadioName := range mtChannel {
 		mtBase := mtIfaceList[mtRadioName]
-		newMtLinks, newMtBoards = "", ""
+		newMtLinks := NewBatchInsert(sqlCreateMTLink1, sqlCreateMTLink2, sqlCreateMTLink3)
+		newMtBoards := NewBatchInsert(sqlCreateMtBoard1, sqlCreateMtBoard2, sqlCreateMtBoard3)
+
+		cred := GetCredential(mtBase["credential_id"])
+		if cred == nil {
+			cred = GetCredentialByName(*mtCredential)
+		}
+		if cred == nil {
+			l.Printf(h.ERROR, "MT %s: credential is not found (credential_id: %s, -credential: %s)", mtBase["ip"], mtBase["credential_id"], *mtCredential)
+			continue
+		}
 
-		if c, err = dial(fmt.Sprintf("%s:8728", mtBase["ip"]), mtBase["username"], mtBase["password"], 3*time.Second); err != nil {
+		if c, err = dial(fmt.Sprintf("%s:8728", mtBase["ip"]), cred.Login, cred.Password, 3*time.Second); err != nil {
 			l.Printf(h.INFO, err.Error())
 			continue
 		}
@@ -148,7 +154,7 @@ func grabeMTQueue(wg *sync.WaitGroup, num int, chanQuery chan string, mtChannel
 				rxSignStrCh0 := signalStrength.FindString(re.Map["signal-strength-ch0"])
 				rxSignStrCh1 := signalStrength.FindString(re.Map["signal-strength-ch1"])
 
-				newMtLinks += fmt.Sprintf(sqlCreateMTLink2, mtBase["iface_id"], mtClient["iface_id"],
+				newMtLinks.Add(mtBase["iface_id"], mtClient["iface_id"],
 					txSignStr, txSignStrCh0, txSignStrCh1, re.Map["tx-ccq"], txRate, tx,
 					rxSignStr, rxSignStrCh0, rxSignStrCh1, re.Map["rx-ccq"], rxRate, rx)
 
@@ -158,17 +164,13 @@ func grabeMTQueue(wg *sync.WaitGroup, num int, chanQuery chan string, mtChannel
 						continue BAD_RESPONCE
 					}
 				}
-				newMtBoards += fmt.Sprintf(sqlCreateMtBoard2, re.Map["radio-name"], re.Map["last-ip"])
+				newMtBoards.Add(re.Map["radio-name"], re.Map["last-ip"])
 			}
 		}
 
-		if newMtLinks != "" {
-			chanQuery <- (sqlCreateMTLink1 + strings.TrimRight(newMtLinks, ", ") + sqlCreateMTLink3)
-		}
+		newMtLinks.Send(chanQuery)
 
-		// if newMtBoards != "" {
-		// 	chanQuery <- (sqlCreateMtBoard1 + strings.TrimRight(newMtBoards, ", ") + sqlCreateMtBoard3)
-		// }
+		// newMtBoards.Send(chanQuery)
 
 	}
 
@@ -0,0 +1,9 @@
+module a4lex/robot_receiver-snmptrap
+
+go 1.16
+
+require (
+	github.com/a4lex/go-helpers v0.0.0-20201223144042-5ec94ac80a60 // indirect
+	github.com/go-sql-driver/mysql v1.6.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
+)
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+	"unicode"
+
+	h "github.com/a4lex/go-helpers"
+	"github.com/gosnmp/gosnmp"
+)
+
+const (
+	oidSysUpTime0   = ".1.3.6.1.2.1.1.3.0"
+	oidSnmpTrapOID0 = ".1.3.6.1.6.3.1.1.4.1.0"
+	oidLinkDown     = ".1.3.6.1.6.3.1.1.5.3"
+	oidLinkUp       = ".1.3.6.1.6.3.1.1.5.4"
+	oidIfIndex      = ".1.3.6.1.2.1.2.2.1.1."
+	oidIfAdmin      = ".1.3.6.1.2.1.2.2.1.7."
+	oidIfOper       = ".1.3.6.1.2.1.2.2.1.8."
+
+	sqlGetDeviceByIP = `SELECT id, device_type_id FROM devices WHERE ip = INET_ATON(?) LIMIT 1`
+	sqlGetEponByIP   = `SELECT id FROM epon WHERE ip = INET_ATON(?) LIMIT 1`
+	sqlGetIfaceByOid = `SELECT id, admin_status, oper_status FROM device_ifaces WHERE device_id = ? AND oid = ? AND active = 1 LIMIT 1`
+
+	sqlUpdateIfaceStatus = `UPDATE device_ifaces SET admin_status = ?, oper_status = ?, last_change = ? WHERE id = ?`
+	sqlCreateStatusEvent = `INSERT INTO iface_events (device_id, iface_id, admin_status, oper_status, old_admin_status, old_oper_status, ` +
+		`last_change, changed_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, NOW())`
+	sqlCreateTrapEvent = `INSERT INTO trap_events (device_id, source, trap_oid, varbinds, created_at) VALUES (?, ?, ?, ?, NOW())`
+
+	sqlUpdateOnuState = `UPDATE onu SET change_state = ? WHERE eponid = ? AND mac = ? LIMIT 1`
+)
+
+var (
+	trapListen    = flag.String("listen", ":162", "Address for listen SNMP traps (UDP)")
+	trapCommunity = flag.String("community", "", "Accept v1/v2c traps only with given community (default - any)")
+
+	trapUser      = flag.String("v3-user", "", "SNMPv3 user for accept v3 traps")
+	trapAuthProto = flag.String("v3-auth-proto", "", "SNMPv3 auth protocol [ MD5, SHA, SHA224, SHA256, SHA384, SHA512 ]")
+	trapAuthKey   = flag.String("v3-auth-key", "", "SNMPv3 auth key")
+	trapPrivProto = flag.String("v3-priv-proto", "", "SNMPv3 priv protocol [ DES, AES, AES192, AES256, AES192C, AES256C ]")
+	trapPrivKey   = flag.String("v3-priv-key", "", "SNMPv3 priv key")
+	trapEngineID  = flag.String("v3-engine-id", "", "SNMPv3 authoritative engine ID of trap sender, hex")
+
+	onuRegTrap   = flag.String("onu-reg-trap", "", "Trap OID of ONU registration on OLT (see MIB of OLT firmware)")
+	onuDeregTrap = flag.String("onu-dereg-trap", "", "Trap OID of ONU deregistration on OLT (see MIB of OLT firmware)")
+)
+
+func process() {
+
+	tl := gosnmp.NewTrapListener()
+	tl.OnNewTrap = handleTrap
+
+	params, err := trapParams()
+	if err != nil {
+		l.Printf(h.FATAL, "Can not init trap listener: %s", err)
+	}
+	tl.Params = params
+
+	// listener is closed on stop signal, there is nothing to do on schedule
+	go func() {
+		<-stop
+		tl.Close()
+	}()
+
+	l.Printf(h.INFO, "Listen SNMP traps on %s", *trapListen)
+	if err := tl.Listen(*trapListen); err != nil && !isStopping() {
+		l.Printf(h.FATAL, "Can not listen SNMP traps on %s: %s", *trapListen, err)
+	}
+}
+
+//
+// trapParams - return params for decode traps, v3 traps are accepted only if -v3-user is set
+//
+func trapParams() (*gosnmp.GoSNMP, error) {
+	params := &gosnmp.GoSNMP{
+		Version:   gosnmp.Version2c,
+		Community: *trapCommunity,
+		Logger:    gosnmp.NewLogger(&trapLogger{}),
+	}
+	if *trapUser == "" {
+		return params, nil
+	}
+
+	auth, ok := snmpAuthProtocols[*trapAuthProto]
+	if !ok {
+		return nil, fmt.Errorf("unknown SNMPv3 auth protocol: %s", *trapAuthProto)
+	}
+	priv, ok := snmpPrivProtocols[*trapPrivProto]
+	if !ok {
+		return nil, fmt.Errorf("unknown SNMPv3 priv protocol: %s", *trapPrivProto)
+	}
+	engineID, err := hex.DecodeString(strings.TrimPrefix(*trapEngineID, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("bad SNMPv3 engine ID: %s", *trapEngineID)
+	}
+
+	params.Version = gosnmp.Version3
+	params.SecurityModel = gosnmp.UserSecurityModel
+	params.MsgFlags = gosnmp.NoAuthNoPriv
+	switch {
+	case auth != gosnmp.NoAuth && priv != gosnmp.NoPriv:
+		params.MsgFlags = gosnmp.AuthPriv
+	case auth != gosnmp.NoAuth:
+		params.MsgFlags = gosnmp.AuthNoPriv
+	}
+	params.SecurityParameters = &gosnmp.UsmSecurityParameters{
+		UserName:                 *trapUser,
+		AuthoritativeEngineID:    string(engineID),
+		AuthenticationProtocol:   auth,
+		AuthenticationPassphrase: *trapAuthKey,
+		PrivacyProtocol:          priv,
+		PrivacyPassphrase:        *trapPrivKey,
+	}
+	return params, nil
+}
+
+//
+// handleTrap - store trap: linkUp/linkDown change status of iface, others are stored in trap_events
+//
+func handleTrap(packet *gosnmp.SnmpPacket, addr *net.UDPAddr) {
+	source := addr.IP.String()
+	// v1 trap carries address of agent, it differs from source if trap is relayed
+	if packet.Version == gosnmp.Version1 && packet.AgentAddress != "" && packet.AgentAddress != "0.0.0.0" {
+		source = packet.AgentAddress
+	}
+
+	if packet.Version != gosnmp.Version3 && *trapCommunity != "" && packet.Community != *trapCommunity {
+		l.Printf(h.INFO, "Drop trap from %s: wrong community", source)
+		return
+	}
+
+	trapOID, upTime := trapInfo(packet)
+	l.Printf(h.DEBUG, "Got trap %s from %s, version: %s, uptime: %d", trapOID, source, packet.Version, upTime)
+
+	dev := mysqli.DBSelectRow(sqlGetDeviceByIP, source)
+
+	switch trapOID {
+	case oidLinkDown, oidLinkUp:
+		if dev["id"] != "" && storeLinkTrap(dev["id"], trapOID == oidLinkUp, upTime, packet.Variables) {
+			return
+		}
+	case *onuRegTrap, *onuDeregTrap:
+		if trapOID != "" {
+			storeOnuTrap(source, trapOID == *onuRegTrap, packet.Variables)
+		}
+	}
+
+	var devID interface{}
+	if dev["id"] != "" {
+		devID = dev["id"]
+	}
+	mysqli.DBQuery(sqlCreateTrapEvent, devID, source, trapOID, trapVarbinds(packet.Variables))
+}
+
+//
+// trapInfo - return trap OID and sysUpTime of agent, v1 trap OID is made as in RFC 3584
+//
+func trapInfo(packet *gosnmp.SnmpPacket) (string, uint32) {
+	if packet.Version == gosnmp.Version1 {
+		trapOID := fmt.Sprintf("%s.0.%d", packet.Enterprise, packet.SpecificTrap)
+		if packet.GenericTrap != 6 {
+			trapOID = fmt.Sprintf(".1.3.6.1.6.3.1.1.5.%d", packet.GenericTrap+1)
+		}
+		return trapOID, uint32(packet.Timestamp)
+	}
+
+	var trapOID string
+	var upTime uint32
+	for _, v := range packet.Variables {
+		switch v.Name {
+		case oidSysUpTime0:
+			upTime = uint32(gosnmp.ToBigInt(v.Value).Uint64())
+		case oidSnmpTrapOID0:
+			if oid, ok := v.Value.(string); ok {
+				trapOID = oid
+			}
+		}
+	}
+	return trapOID, upTime
+}
+
+//
+// storeLinkTrap - update status of iface by linkUp/linkDown and store its change in iface_events,
+// return false if iface is not found
+//
+func storeLinkTrap(devID string, up bool, upTime uint32, vars []gosnmp.SnmpPDU) bool {
+	var ifIndex, admin, oper string
+	for _, v := range vars {
+		switch {
+		case strings.HasPrefix(v.Name, oidIfIndex):
+			ifIndex = gosnmp.ToBigInt(v.Value).String()
+		case strings.HasPrefix(v.Name, oidIfAdmin):
+			ifIndex, admin = strings.TrimPrefix(v.Name, oidIfAdmin), gosnmp.ToBigInt(v.Value).String()
+		case strings.HasPrefix(v.Name, oidIfOper):
+			ifIndex, oper = strings.TrimPrefix(v.Name, oidIfOper), gosnmp.ToBigInt(v.Value).String()
+		}
+	}
+
+	iface := mysqli.DBSelectRow(sqlGetIfaceByOid, devID, ifIndex)
+	if iface["id"] == "" {
+		l.Printf(h.INFO, "Device %s, iface with ifIndex '%s' is not found", devID, ifIndex)
+		return false
+	}
+
+	// trap without status varbinds: linkUp means admin and oper up, linkDown - oper down
+	if oper == "" {
+		oper = "2"
+		if up {
+			oper = "1"
+		}
+	}
+	if admin == "" {
+		admin = iface["admin_status"]
+		if up || admin == "" {
+			admin = "1"
+		}
+	}
+
+	l.Printf(h.INFO, "Device %s, iface %s: admin %s -> %s, oper %s -> %s (trap)", devID, iface["id"],
+		iface["admin_status"], admin, iface["oper_status"], oper)
+	mysqli.DBQuery(sqlUpdateIfaceStatus, admin, oper, upTime, iface["id"])
+
+	// iface without stored status gets only status, as on first poll
+	if iface["admin_status"] != "" && (admin != iface["admin_status"] || oper != iface["oper_status"]) {
+		mysqli.DBQuery(sqlCreateStatusEvent, devID, iface["id"], admin, oper, iface["admin_status"], iface["oper_status"],
+			upTime, time.Now().Format("2006-01-02 15:04:05"))
+	}
+	return true
+}
+
+//
+// storeOnuTrap - mark ONU of registration/deregistration trap, MAC of ONU is taken from 6-byte varbind
+//
+func storeOnuTrap(source string, reg bool, vars []gosnmp.SnmpPDU) {
+	epon := mysqli.DBSelectRow(sqlGetEponByIP, source)
+	if epon["id"] == "" {
+		l.Printf(h.INFO, "Got ONU trap from unknown EPON %s", source)
+		return
+	}
+
+	for _, v := range vars {
+		if mac, ok := v.Value.([]byte); ok && v.Type == gosnmp.OctetString && len(mac) == 6 {
+			changeState := 1
+			if reg {
+				changeState = 0
+			}
+			_mac := strings.ToUpper(net.HardwareAddr(mac).String())
+			l.Printf(h.INFO, "EPON %s, ONU %s: registered: %t (trap)", epon["id"], _mac, reg)
+			mysqli.DBQuery(sqlUpdateOnuState, changeState, epon["id"], _mac)
+			return
+		}
+	}
+	l.Printf(h.INFO, "EPON %s, ONU trap without MAC", epon["id"])
+}
+
+//
+// trapVarbinds - return varbinds of trap as text, one per line
+//
+func trapVarbinds(vars []gosnmp.SnmpPDU) string {
+	lines := make([]string, 0, len(vars))
+	for _, v := range vars {
+		var val string
+		switch v.Type {
+		case gosnmp.OctetString:
+			b := v.Value.([]byte)
+			val = string(b)
+			if strings.IndexFunc(val, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+				val = hex.EncodeToString(b)
+			}
+		case gosnmp.ObjectIdentifier, gosnmp.IPAddress:
+			val = fmt.Sprintf("%v", v.Value)
+		case gosnmp.Null, gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView:
+			val = "null"
+		default:
+			val = gosnmp.ToBigInt(v.Value).String()
+		}
+		lines = append(lines, fmt.Sprintf("%s = %s", v.Name, val))
+	}
+	return strings.Join(lines, "\n")
+}
+
+//
+// trapLogger - write decode errors of gosnmp to log of robot
+//
+type trapLogger struct{}
+
+func (tl *trapLogger) Print(v ...interface{}) {
+	l.Printf(h.DEBUG, "gosnmp: %s", strings.TrimSpace(fmt.Sprint(v...)))
+}
+
+func (tl *trapLogger) Printf(format string, v ...interface{}) {
+	l.Printf(h.DEBUG, "gosnmp: %s", strings.TrimSpace(fmt.Sprintf(format, v...)))
+}
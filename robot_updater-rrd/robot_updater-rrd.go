@@ -4,7 +4,6 @@ import (
 	"flag"
 	"fmt"
 	"math/big"
-	"os"
 	"strconv"
 	"time"
 
@@ -36,12 +35,8 @@ func process() {
 	var listVals []map[string]string
 
 	for _, template := range listSNMPTemplates {
-
-		// create dir for rrd files, for current template
-		rrdDirTemplate := fmt.Sprintf("%s/%s", *dirRRD, template["path"])
-		if _, err := os.Stat(rrdDirTemplate); os.IsNotExist(err) {
-			os.MkdirAll(rrdDirTemplate, os.ModePerm)
-			l.Printf(h.INFO, "Create dir for RRD files: %s", rrdDirTemplate)
+		if isStopping() {
+			break
 		}
 
 		rate := new(big.Float)
@@ -49,6 +44,7 @@ func process() {
 		min, _ := strconv.Atoi(template["min"])
 		max, _ := strconv.Atoi(template["max"])
 		step, _ := strconv.ParseUint(template["step"], 10, 32)
+		UpdateCycleStep(uint(step))
 
 		// loop by values of template
 		// select not all values, pick just part
@@ -58,20 +54,23 @@ func process() {
 			listVals = mysqli.DBSelectList(fmt.Sprintf("%s LIMIT %d, %d", template["query"], offset, *maxPerUpdate))
 			for _, val := range listVals {
 
-				// store value in rrd db or create it
-				fileRRD := fmt.Sprintf("%s/%s", rrdDirTemplate, val["file"])
+				// store value in all sinks
+				series := &Series{
+					Path:        template["path"],
+					ObjectID:    val["file"],
+					File:        val["file"],
+					CounterType: template["type"],
+					Min:         min,
+					Max:         max,
+					Step:        uint(step),
+				}
 
 				valRRD := new(big.Float)
 				valRRD.SetString(val["val"])
 				valRRD = valRRD.Mul(valRRD, rate)
 
-				if err := RRDUpdate(fileRRD, timeUpdRRD, fmt.Sprintf("%.0f", valRRD)); err != nil {
-					if _, err := os.Stat(fileRRD); os.IsExist(err) {
-						continue
-					}
-					if _, err := RRDCreate(fileRRD, template["type"], min, max, uint(step)); err != nil {
-						l.Printf(h.ERROR, "Can not create rrddb: %s - %s", val["path"], err)
-					}
+				if err := sinks.Store(series, timeUpdRRD, valRRD); err != nil {
+					l.Printf(h.ERROR, "Can not store value: %s/%s - %s", template["path"], val["file"], err)
 				}
 			}
 
@@ -0,0 +1,731 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//
+// Native implementation of rrdtool file format (version 0003, x86_64 layout),
+// so robots do not need cgo and rrdtool-devel for write graph data.
+// Supported DS types: GAUGE, COUNTER, DERIVE, ABSOLUTE
+// Supported CF: AVERAGE, MIN, MAX, LAST
+//
+
+const (
+	rrdCookie      = "RRD"
+	rrdVersion     = "0003"
+	rrdFloatCookie = 8.642135e130
+
+	rrdStatHeadSize = 128
+	rrdDefSize      = 120 // ds_def_t and rra_def_t have the same size
+	rrdPDPPrepSize  = 112
+	rrdCDPPrepSize  = 80
+	rrdNameSize     = 20
+	rrdLastDSSize   = 30
+
+	// indexes of unival params
+	rrdDSHeartbeat   = 0
+	rrdDSMin         = 1
+	rrdDSMax         = 2
+	rrdRRAXff        = 0
+	rrdPDPUnknSecCnt = 0
+	rrdPDPVal        = 1
+	rrdCDPVal        = 0
+	rrdCDPUnknPDPCnt = 1
+	rrdCDPPrimary    = 8
+	rrdCDPSecondary  = 9
+)
+
+//
+// RRDDataSource struct for describe DS of RRD DB
+//
+type RRDDataSource struct {
+	Name      string
+	Type      string
+	Heartbeat uint
+	Min       float64 // math.NaN() - unknown
+	Max       float64 // math.NaN() - unknown
+}
+
+//
+// RRDArchive struct for describe RRA of RRD DB
+//
+type RRDArchive struct {
+	CF     string
+	Xff    float64
+	PDPCnt uint
+	RowCnt uint
+}
+
+type rrdUnival [10]uint64
+
+type rrdDef struct {
+	name string
+	typ  string
+	rows uint64
+	pdps uint64
+	par  rrdUnival
+}
+
+type rrdPDPPrep struct {
+	lastDS  string
+	scratch rrdUnival
+}
+
+type rrdHeader struct {
+	version    string
+	pdpStep    uint64
+	ds         []rrdDef
+	rra        []rrdDef
+	lastUp     int64
+	lastUpUsec int64
+	pdpPrep    []rrdPDPPrep
+	cdpPrep    []rrdUnival
+	rraPtr     []uint64
+}
+
+//
+// RRDDefaultArchives - return list of RRA which used by all robots
+// (1, 7, 30 and 365 steps per row, 288 rows for each CF)
+//
+func RRDDefaultArchives() []RRDArchive {
+	rra := make([]RRDArchive, 0, 16)
+	for _, pdpCnt := range []uint{1, 7, 30, 365} {
+		for _, cf := range []string{"AVERAGE", "LAST", "MIN", "MAX"} {
+			rra = append(rra, RRDArchive{CF: cf, Xff: 0.5, PDPCnt: pdpCnt, RowCnt: 288})
+		}
+	}
+	return rra
+}
+
+//
+// RRDCreateFile - create new RRD DB file, existing file will be overwritten
+//
+func RRDCreateFile(dbfile string, start time.Time, step uint, ds []RRDDataSource, rra []RRDArchive) error {
+	if step == 0 {
+		return fmt.Errorf("step of RRD DB can not be zero")
+	}
+	if len(ds) == 0 || len(rra) == 0 {
+		return fmt.Errorf("RRD DB should have at least one DS and one RRA")
+	}
+
+	hd := &rrdHeader{
+		version: rrdVersion,
+		pdpStep: uint64(step),
+		lastUp:  start.Unix(),
+	}
+
+	for _, d := range ds {
+		switch d.Type {
+		case "GAUGE", "COUNTER", "DERIVE", "ABSOLUTE":
+		default:
+			return fmt.Errorf("unsupported DS type: %s", d.Type)
+		}
+		if len(d.Name) >= rrdNameSize {
+			return fmt.Errorf("DS name is too long: %s", d.Name)
+		}
+		if !math.IsNaN(d.Min) && !math.IsNaN(d.Max) && d.Min >= d.Max {
+			return fmt.Errorf("min must be less than max in DS definition: %s", d.Name)
+		}
+		def := rrdDef{name: d.Name, typ: d.Type}
+		def.par[rrdDSHeartbeat] = uint64(d.Heartbeat)
+		def.par.set(rrdDSMin, d.Min)
+		def.par.set(rrdDSMax, d.Max)
+		hd.ds = append(hd.ds, def)
+
+		prep := rrdPDPPrep{lastDS: "U"}
+		prep.scratch[rrdPDPUnknSecCnt] = uint64(hd.lastUp) % hd.pdpStep
+		prep.scratch.set(rrdPDPVal, 0)
+		hd.pdpPrep = append(hd.pdpPrep, prep)
+	}
+
+	for _, a := range rra {
+		switch a.CF {
+		case "AVERAGE", "MIN", "MAX", "LAST":
+		default:
+			return fmt.Errorf("unsupported consolidation function: %s", a.CF)
+		}
+		if a.PDPCnt == 0 || a.RowCnt == 0 {
+			return fmt.Errorf("steps and rows of RRA should be greater than zero")
+		}
+		def := rrdDef{name: a.CF, rows: uint64(a.RowCnt), pdps: uint64(a.PDPCnt)}
+		def.par.set(rrdRRAXff, a.Xff)
+		hd.rra = append(hd.rra, def)
+		hd.rraPtr = append(hd.rraPtr, def.rows-1)
+
+		for range hd.ds {
+			var cdp rrdUnival
+			cdp.set(rrdCDPVal, math.NaN())
+			cdp.set(rrdCDPPrimary, math.NaN())
+			cdp.set(rrdCDPSecondary, math.NaN())
+			cdp[rrdCDPUnknPDPCnt] = ((uint64(hd.lastUp) - hd.pdpPrep[0].scratch[rrdPDPUnknSecCnt]) %
+				(hd.pdpStep * def.pdps)) / hd.pdpStep
+			hd.cdpPrep = append(hd.cdpPrep, cdp)
+		}
+	}
+
+	f, err := os.OpenFile(dbfile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = rrdLock(f); err != nil {
+		return err
+	}
+
+	// all rows of all RRA are unknown
+	nan := make([]byte, 8)
+	binary.LittleEndian.PutUint64(nan, math.Float64bits(math.NaN()))
+	rows := hd.rowsTotal() * uint64(len(hd.ds))
+	data := make([]byte, 0, len(hd.marshal())+int(rows)*8)
+	data = append(data, hd.marshal()...)
+	for i := uint64(0); i < rows; i++ {
+		data = append(data, nan...)
+	}
+
+	_, err = f.Write(data)
+	return err
+}
+
+//
+// RRDUpdateFile - update RRD DB file with given values (one per DS, "U" - unknown) and time
+//
+func RRDUpdateFile(dbfile string, t time.Time, vals ...string) error {
+	f, err := os.OpenFile(dbfile, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = rrdLock(f); err != nil {
+		return err
+	}
+
+	hd, err := rrdReadHeader(f)
+	if err != nil {
+		return err
+	}
+
+	if len(vals) != len(hd.ds) {
+		return fmt.Errorf("expected %d data source readings (got %d)", len(hd.ds), len(vals))
+	}
+
+	curTime, curUsec := t.Unix(), int64(t.Nanosecond()/1000)
+	interval := float64(curTime-hd.lastUp) + float64(curUsec-hd.lastUpUsec)/1e6
+	if interval <= 0 {
+		return fmt.Errorf("illegal attempt to update using time %d when last update time is %d (minimum one second step)",
+			curTime, hd.lastUp)
+	}
+
+	step := int64(hd.pdpStep)
+	procPdpSt := hd.lastUp - hd.lastUp%step
+	occuPdpAge := curTime % step
+	occuPdpSt := curTime - occuPdpAge
+
+	preInt, postInt := interval, 0.0
+	if occuPdpSt > procPdpSt {
+		preInt = float64(occuPdpSt-hd.lastUp) - float64(hd.lastUpUsec)/1e6
+		postInt = float64(occuPdpAge) + float64(curUsec)/1e6
+	}
+
+	pdpNew, err := hd.pdpNew(interval, vals)
+	if err != nil {
+		return err
+	}
+
+	if elapsed := uint64((occuPdpSt - procPdpSt) / step); elapsed == 0 {
+		hd.simpleUpdate(interval, pdpNew)
+	} else {
+		pdpTemp := hd.processPDP(interval, preInt, postInt, elapsed, pdpNew)
+		stepCnt := hd.updateCDP(uint64(procPdpSt)/hd.pdpStep, elapsed, pdpTemp)
+		if err = hd.writeRows(f, stepCnt); err != nil {
+			return err
+		}
+	}
+
+	hd.lastUp, hd.lastUpUsec = curTime, curUsec
+	_, err = f.WriteAt(hd.marshal(), 0)
+	return err
+}
+
+//
+// pdpNew - calculate rate*seconds for each DS from given values
+//
+func (hd *rrdHeader) pdpNew(interval float64, vals []string) ([]float64, error) {
+	pdpNew := make([]float64, len(hd.ds))
+
+	for i, ds := range hd.ds {
+		prep := &hd.pdpPrep[i]
+		heartbeat := float64(ds.par[rrdDSHeartbeat])
+		val := strings.TrimSpace(vals[i])
+		pdpNew[i] = math.NaN()
+
+		// do not build diffs with too old last_ds values
+		if heartbeat < interval {
+			prep.lastDS = "U"
+		}
+
+		if val != "U" && val != "" && heartbeat >= interval {
+			switch ds.typ {
+			case "COUNTER", "DERIVE":
+				cur, ok := new(big.Int).SetString(val, 10)
+				if !ok || (ds.typ == "COUNTER" && cur.Sign() < 0) {
+					return nil, fmt.Errorf("not a simple integer: '%s'", val)
+				}
+				if prev, ok := new(big.Int).SetString(prep.lastDS, 10); ok {
+					pdpNew[i], _ = new(big.Float).SetInt(cur.Sub(cur, prev)).Float64()
+					if ds.typ == "COUNTER" {
+						// simple overflow catcher for 32 and 64 bit counters
+						if pdpNew[i] < 0 {
+							pdpNew[i] += 4294967296.0
+						}
+						if pdpNew[i] < 0 {
+							pdpNew[i] += 18446744069414584320.0
+						}
+					}
+				}
+			case "ABSOLUTE", "GAUGE":
+				v, err := strconv.ParseFloat(val, 64)
+				if err != nil {
+					return nil, fmt.Errorf("converting '%s' to float: %s", val, err)
+				}
+				if pdpNew[i] = v; ds.typ == "GAUGE" {
+					pdpNew[i] = v * interval
+				}
+			}
+
+			// value out of min/max range become unknown
+			rate := pdpNew[i] / interval
+			if min, max := ds.par.get(rrdDSMin), ds.par.get(rrdDSMax); !math.IsNaN(rate) &&
+				((!math.IsNaN(max) && rate > max) || (!math.IsNaN(min) && rate < min)) {
+				pdpNew[i] = math.NaN()
+			}
+		}
+
+		if len(val) >= rrdLastDSSize {
+			val = val[:rrdLastDSSize-1]
+		}
+		if val == "" {
+			val = "U"
+		}
+		prep.lastDS = val
+	}
+
+	return pdpNew, nil
+}
+
+//
+// simpleUpdate - update pdp_prep when pdp_st moment was not passed
+//
+func (hd *rrdHeader) simpleUpdate(interval float64, pdpNew []float64) {
+	for i := range hd.ds {
+		scratch := &hd.pdpPrep[i].scratch
+		if math.IsNaN(pdpNew[i]) {
+			scratch[rrdPDPUnknSecCnt] += uint64(math.Floor(interval))
+		} else if cur := scratch.get(rrdPDPVal); math.IsNaN(cur) {
+			scratch.set(rrdPDPVal, pdpNew[i])
+		} else {
+			scratch.set(rrdPDPVal, cur+pdpNew[i])
+		}
+	}
+}
+
+//
+// processPDP - calculate rate of passed pdp and prepare pdp_prep for the next run
+//
+func (hd *rrdHeader) processPDP(interval, preInt, postInt float64, elapsed uint64, pdpNew []float64) []float64 {
+	pdpTemp := make([]float64, len(hd.ds))
+
+	for i, ds := range hd.ds {
+		scratch := &hd.pdpPrep[i].scratch
+		preUnknown := 0.0
+
+		if math.IsNaN(pdpNew[i]) {
+			preUnknown = preInt
+		} else {
+			cur := scratch.get(rrdPDPVal)
+			if math.IsNaN(cur) {
+				cur = 0
+			}
+			scratch.set(rrdPDPVal, cur+pdpNew[i]/interval*preInt)
+		}
+
+		// if too much of the pdp_prep is unknown we dump it
+		if interval > float64(ds.par[rrdDSHeartbeat]) || float64(hd.pdpStep)/2.0 < float64(int64(scratch[rrdPDPUnknSecCnt])) {
+			pdpTemp[i] = math.NaN()
+		} else {
+			pdpTemp[i] = scratch.get(rrdPDPVal) /
+				(float64(int64(elapsed*hd.pdpStep)-int64(scratch[rrdPDPUnknSecCnt])) - preUnknown)
+		}
+
+		if math.IsNaN(pdpNew[i]) {
+			scratch[rrdPDPUnknSecCnt] = uint64(math.Floor(postInt))
+			scratch.set(rrdPDPVal, math.NaN())
+		} else {
+			scratch[rrdPDPUnknSecCnt] = 0
+			scratch.set(rrdPDPVal, pdpNew[i]/interval*postInt)
+		}
+	}
+
+	return pdpTemp
+}
+
+//
+// updateCDP - consolidate pdp into cdp_prep, return count of rows for write per RRA
+//
+func (hd *rrdHeader) updateCDP(procPdpCnt, elapsed uint64, pdpTemp []float64) []uint64 {
+	stepCnt := make([]uint64, len(hd.rra))
+
+	for r, rra := range hd.rra {
+		startPdpOffset := rra.pdps - procPdpCnt%rra.pdps
+		if startPdpOffset <= elapsed {
+			stepCnt[r] = (elapsed-startPdpOffset)/rra.pdps + 1
+		}
+
+		for i := range hd.ds {
+			scratch := &hd.cdpPrep[r*len(hd.ds)+i]
+			val := pdpTemp[i]
+
+			if rra.pdps == 1 {
+				// nothing to consolidate if there's one PDP per CDP
+				scratch.set(rrdCDPPrimary, val)
+				scratch.set(rrdCDPSecondary, val)
+				continue
+			}
+
+			if stepCnt[r] == 0 {
+				if math.IsNaN(val) {
+					scratch[rrdCDPUnknPDPCnt] += elapsed
+				} else {
+					scratch.set(rrdCDPVal, rrdConsolidate(rra.name, scratch.get(rrdCDPVal), val, elapsed))
+				}
+				continue
+			}
+
+			if math.IsNaN(val) {
+				scratch[rrdCDPUnknPDPCnt] += startPdpOffset
+			}
+			// "fill in" value for intermediary rows
+			scratch.set(rrdCDPSecondary, val)
+
+			if float64(scratch[rrdCDPUnknPDPCnt]) > float64(rra.pdps)*rra.par.get(rrdRRAXff) {
+				scratch.set(rrdCDPPrimary, math.NaN())
+			} else {
+				scratch.set(rrdCDPPrimary, rrdPrimary(rra.name, scratch, val, startPdpOffset, rra.pdps))
+			}
+
+			// carry over value for the next cdp
+			intoCdp := (elapsed - startPdpOffset) % rra.pdps
+			switch {
+			case intoCdp == 0 || math.IsNaN(val):
+				scratch.set(rrdCDPVal, rrdInitialCDP(rra.name))
+			case rra.name == "AVERAGE":
+				scratch.set(rrdCDPVal, val*float64(intoCdp))
+			default:
+				scratch.set(rrdCDPVal, val)
+			}
+
+			if math.IsNaN(val) {
+				scratch[rrdCDPUnknPDPCnt] = intoCdp
+			} else {
+				scratch[rrdCDPUnknPDPCnt] = 0
+			}
+		}
+	}
+
+	return stepCnt
+}
+
+//
+// writeRows - write consolidated rows into RRA and move rra_ptr
+//
+func (hd *rrdHeader) writeRows(f *os.File, stepCnt []uint64) error {
+	offset := int64(hd.size())
+	row := make([]byte, 8*len(hd.ds))
+
+	for r, rra := range hd.rra {
+		cnt, idx := stepCnt[r], rrdCDPPrimary
+
+		// rows which will be overwritten in the same update are skipped
+		if cnt > rra.rows {
+			hd.rraPtr[r] = (hd.rraPtr[r] + cnt - rra.rows) % rra.rows
+			cnt, idx = rra.rows, rrdCDPSecondary
+		}
+
+		for ; cnt > 0; cnt-- {
+			hd.rraPtr[r] = (hd.rraPtr[r] + 1) % rra.rows
+			for i := range hd.ds {
+				binary.LittleEndian.PutUint64(row[i*8:], hd.cdpPrep[r*len(hd.ds)+i][idx])
+			}
+			if _, err := f.WriteAt(row, offset+int64(hd.rraPtr[r])*int64(len(row))); err != nil {
+				return err
+			}
+			idx = rrdCDPSecondary
+		}
+
+		offset += int64(rra.rows) * int64(len(row))
+	}
+
+	return nil
+}
+
+func rrdConsolidate(cf string, cdp, val float64, elapsed uint64) float64 {
+	switch {
+	case math.IsNaN(cdp) && cf == "AVERAGE":
+		return val * float64(elapsed)
+	case math.IsNaN(cdp):
+		return val
+	case cf == "AVERAGE":
+		return cdp + val*float64(elapsed)
+	case cf == "MIN":
+		return math.Min(cdp, val)
+	case cf == "MAX":
+		return math.Max(cdp, val)
+	}
+	return val
+}
+
+func rrdPrimary(cf string, scratch *rrdUnival, val float64, startPdpOffset, pdpCnt uint64) float64 {
+	cum := scratch.get(rrdCDPVal)
+	switch cf {
+	case "AVERAGE":
+		return (rrdIfNaN(cum, 0) + rrdIfNaN(val, 0)*float64(startPdpOffset)) /
+			float64(pdpCnt-scratch[rrdCDPUnknPDPCnt])
+	case "MAX":
+		return math.Max(rrdIfNaN(cum, math.Inf(-1)), rrdIfNaN(val, math.Inf(-1)))
+	case "MIN":
+		return math.Min(rrdIfNaN(cum, math.Inf(1)), rrdIfNaN(val, math.Inf(1)))
+	}
+	return val
+}
+
+func rrdInitialCDP(cf string) float64 {
+	switch cf {
+	case "MAX":
+		return math.Inf(-1)
+	case "MIN":
+		return math.Inf(1)
+	case "AVERAGE":
+		return 0
+	}
+	return math.NaN()
+}
+
+func rrdIfNaN(val, def float64) float64 {
+	if math.IsNaN(val) {
+		return def
+	}
+	return val
+}
+
+//
+// rrdLock - set exclusive lock on RRD DB file, same as rrdtool does
+//
+func rrdLock(f *os.File) error {
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lock); err != nil {
+		return fmt.Errorf("could not lock RRD DB %s: %s", f.Name(), err)
+	}
+	return nil
+}
+
+//
+// rrdReadHeader - read and check all header sections of RRD DB file
+//
+func rrdReadHeader(f *os.File) (*rrdHeader, error) {
+	buf := make([]byte, rrdStatHeadSize)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return nil, fmt.Errorf("can not read RRD DB header %s: %s", f.Name(), err)
+	}
+
+	if rrdString(buf[0:4]) != rrdCookie {
+		return nil, fmt.Errorf("%s is not an RRD file", f.Name())
+	}
+	if math.Float64frombits(binary.LittleEndian.Uint64(buf[16:])) != rrdFloatCookie {
+		return nil, fmt.Errorf("%s is not an RRD file of x86_64 architecture", f.Name())
+	}
+
+	hd := &rrdHeader{
+		version: rrdString(buf[4:9]),
+		pdpStep: binary.LittleEndian.Uint64(buf[40:]),
+	}
+	switch hd.version {
+	case "0001", "0002", "0003":
+	default:
+		return nil, fmt.Errorf("unsupported version of RRD file %s: %s", f.Name(), hd.version)
+	}
+	if hd.pdpStep == 0 {
+		return nil, fmt.Errorf("broken RRD file %s: step is zero", f.Name())
+	}
+
+	hd.ds = make([]rrdDef, binary.LittleEndian.Uint64(buf[24:]))
+	hd.rra = make([]rrdDef, binary.LittleEndian.Uint64(buf[32:]))
+	hd.pdpPrep = make([]rrdPDPPrep, len(hd.ds))
+	hd.cdpPrep = make([]rrdUnival, len(hd.ds)*len(hd.rra))
+	hd.rraPtr = make([]uint64, len(hd.rra))
+
+	buf = make([]byte, hd.size())
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return nil, fmt.Errorf("can not read RRD DB header %s: %s", f.Name(), err)
+	}
+
+	offset := rrdStatHeadSize
+	for i := range hd.ds {
+		hd.ds[i].name = rrdString(buf[offset : offset+rrdNameSize])
+		hd.ds[i].typ = rrdString(buf[offset+rrdNameSize : offset+2*rrdNameSize])
+		hd.ds[i].par.unmarshal(buf[offset+40:])
+		offset += rrdDefSize
+	}
+	for i := range hd.rra {
+		hd.rra[i].name = rrdString(buf[offset : offset+rrdNameSize])
+		hd.rra[i].rows = binary.LittleEndian.Uint64(buf[offset+24:])
+		hd.rra[i].pdps = binary.LittleEndian.Uint64(buf[offset+32:])
+		hd.rra[i].par.unmarshal(buf[offset+40:])
+		if hd.rra[i].rows == 0 || hd.rra[i].pdps == 0 {
+			return nil, fmt.Errorf("broken RRD file %s: empty RRA", f.Name())
+		}
+		offset += rrdDefSize
+	}
+	hd.lastUp = int64(binary.LittleEndian.Uint64(buf[offset:]))
+	offset += 8
+	if hd.version >= "0003" {
+		hd.lastUpUsec = int64(binary.LittleEndian.Uint64(buf[offset:]))
+		offset += 8
+	}
+	for i := range hd.pdpPrep {
+		hd.pdpPrep[i].lastDS = rrdString(buf[offset : offset+rrdLastDSSize])
+		hd.pdpPrep[i].scratch.unmarshal(buf[offset+32:])
+		offset += rrdPDPPrepSize
+	}
+	for i := range hd.cdpPrep {
+		hd.cdpPrep[i].unmarshal(buf[offset:])
+		offset += rrdCDPPrepSize
+	}
+	for i := range hd.rraPtr {
+		hd.rraPtr[i] = binary.LittleEndian.Uint64(buf[offset:])
+		offset += 8
+	}
+
+	for _, ds := range hd.ds {
+		switch ds.typ {
+		case "GAUGE", "COUNTER", "DERIVE", "ABSOLUTE":
+		default:
+			return nil, fmt.Errorf("unsupported DS type in %s: %s", f.Name(), ds.typ)
+		}
+	}
+	for _, rra := range hd.rra {
+		switch rra.name {
+		case "AVERAGE", "MIN", "MAX", "LAST":
+		default:
+			return nil, fmt.Errorf("unsupported consolidation function in %s: %s", f.Name(), rra.name)
+		}
+	}
+
+	return hd, nil
+}
+
+//
+// size - return size of all header sections, data of RRA start after it
+//
+func (hd *rrdHeader) size() int {
+	liveHead := 16
+	if hd.version < "0003" {
+		liveHead = 8
+	}
+	return rrdStatHeadSize + rrdDefSize*(len(hd.ds)+len(hd.rra)) + liveHead +
+		rrdPDPPrepSize*len(hd.ds) + rrdCDPPrepSize*len(hd.cdpPrep) + 8*len(hd.rraPtr)
+}
+
+func (hd *rrdHeader) rowsTotal() (rows uint64) {
+	for _, rra := range hd.rra {
+		rows += rra.rows
+	}
+	return
+}
+
+//
+// marshal - encode all header sections into binary form
+//
+func (hd *rrdHeader) marshal() []byte {
+	buf := make([]byte, hd.size())
+
+	copy(buf[0:], rrdCookie)
+	copy(buf[4:], hd.version)
+	binary.LittleEndian.PutUint64(buf[16:], math.Float64bits(rrdFloatCookie))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(len(hd.ds)))
+	binary.LittleEndian.PutUint64(buf[32:], uint64(len(hd.rra)))
+	binary.LittleEndian.PutUint64(buf[40:], hd.pdpStep)
+
+	offset := rrdStatHeadSize
+	for _, ds := range hd.ds {
+		copy(buf[offset:offset+rrdNameSize-1], ds.name)
+		copy(buf[offset+rrdNameSize:offset+2*rrdNameSize-1], ds.typ)
+		ds.par.marshal(buf[offset+40:])
+		offset += rrdDefSize
+	}
+	for _, rra := range hd.rra {
+		copy(buf[offset:offset+rrdNameSize-1], rra.name)
+		binary.LittleEndian.PutUint64(buf[offset+24:], rra.rows)
+		binary.LittleEndian.PutUint64(buf[offset+32:], rra.pdps)
+		rra.par.marshal(buf[offset+40:])
+		offset += rrdDefSize
+	}
+	binary.LittleEndian.PutUint64(buf[offset:], uint64(hd.lastUp))
+	offset += 8
+	if hd.version >= "0003" {
+		binary.LittleEndian.PutUint64(buf[offset:], uint64(hd.lastUpUsec))
+		offset += 8
+	}
+	for _, prep := range hd.pdpPrep {
+		copy(buf[offset:offset+rrdLastDSSize-1], prep.lastDS)
+		prep.scratch.marshal(buf[offset+32:])
+		offset += rrdPDPPrepSize
+	}
+	for _, cdp := range hd.cdpPrep {
+		cdp.marshal(buf[offset:])
+		offset += rrdCDPPrepSize
+	}
+	for _, ptr := range hd.rraPtr {
+		binary.LittleEndian.PutUint64(buf[offset:], ptr)
+		offset += 8
+	}
+
+	return buf
+}
+
+func (u *rrdUnival) get(i int) float64 {
+	return math.Float64frombits(u[i])
+}
+
+func (u *rrdUnival) set(i int, val float64) {
+	u[i] = math.Float64bits(val)
+}
+
+func (u *rrdUnival) marshal(buf []byte) {
+	for i, v := range u {
+		binary.LittleEndian.PutUint64(buf[i*8:], v)
+	}
+}
+
+func (u *rrdUnival) unmarshal(buf []byte) {
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint64(buf[i*8:])
+	}
+}
+
+func rrdString(buf []byte) string {
+	if i := strings.IndexByte(string(buf), 0); i >= 0 {
+		return string(buf[:i])
+	}
+	return string(buf)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// Expected rows follow the update algorithm of rrdtool (rrd_update.c): PDP of partial steps is
+// averaged by seconds, PDP is unknown when more than half of step is unknown, CDP is unknown when
+// more than xff of its PDPs are unknown, COUNTER wraps at 2^32. If rrdtool is in PATH,
+// TestRRDCompareRRDTool checks files against real rrdtool.
+//
+
+// t0 is aligned to 3 steps of 300 sec, so CDPs of 3 PDPs start at t0
+const rrdTestStart = 900 * 400
+
+var rrdTestArchives = []RRDArchive{
+	{CF: "AVERAGE", Xff: 0.5, PDPCnt: 1, RowCnt: 10},
+	{CF: "AVERAGE", Xff: 0.5, PDPCnt: 3, RowCnt: 5},
+	{CF: "MAX", Xff: 0.5, PDPCnt: 3, RowCnt: 5},
+	{CF: "MIN", Xff: 0.5, PDPCnt: 3, RowCnt: 5},
+	{CF: "LAST", Xff: 0.5, PDPCnt: 3, RowCnt: 5},
+}
+
+type rrdTestUpdate struct {
+	sec int64 // from t0
+	val string
+}
+
+func rrdTestFile(t *testing.T, typ string, updates []rrdTestUpdate) string {
+	t.Helper()
+	dbfile := filepath.Join(t.TempDir(), "test.rrd")
+	ds := []RRDDataSource{{Name: "val", Type: typ, Heartbeat: 600, Min: 0, Max: math.NaN()}}
+	if err := RRDCreateFile(dbfile, time.Unix(rrdTestStart, 0), 300, ds, rrdTestArchives); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	for _, u := range updates {
+		if err := RRDUpdateFile(dbfile, time.Unix(rrdTestStart+u.sec, 0), u.val); err != nil {
+			t.Fatalf("update %d:%s: %s", u.sec, u.val, err)
+		}
+	}
+	return dbfile
+}
+
+//
+// rrdTestRows - return rows of RRA from oldest to newest, as rrdtool fetch does
+//
+func rrdTestRows(t *testing.T, dbfile string, rra int) []float64 {
+	t.Helper()
+	f, err := os.Open(dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	hd, err := rrdReadHeader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := int64(hd.size())
+	for r := 0; r < rra; r++ {
+		offset += int64(hd.rra[r].rows) * int64(8*len(hd.ds))
+	}
+
+	rows := make([]float64, hd.rra[rra].rows)
+	buf := make([]byte, 8)
+	for i := range rows {
+		row := (hd.rraPtr[rra] + 1 + uint64(i)) % hd.rra[rra].rows
+		if _, err := f.ReadAt(buf, offset+int64(row)*8); err != nil {
+			t.Fatal(err)
+		}
+		rows[i] = math.Float64frombits(binary.LittleEndian.Uint64(buf))
+	}
+	return rows
+}
+
+//
+// rrdTestLast - compare newest rows of RRA with expected, NaN is unknown
+//
+func rrdTestLast(t *testing.T, dbfile string, rra int, expected ...float64) {
+	t.Helper()
+	rows := rrdTestRows(t, dbfile, rra)
+	rows = rows[len(rows)-len(expected):]
+	for i := range expected {
+		if math.IsNaN(expected[i]) != math.IsNaN(rows[i]) ||
+			(!math.IsNaN(expected[i]) && math.Abs(expected[i]-rows[i]) > 1e-9) {
+			t.Errorf("RRA %d (%s): rows %v, expected %v", rra, rrdTestArchives[rra].CF, rows, expected)
+			return
+		}
+	}
+}
+
+func TestRRDCreateHeader(t *testing.T) {
+	dbfile := rrdTestFile(t, "GAUGE", nil)
+
+	data, err := os.ReadFile(dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stat_head, 1 ds_def, 5 rra_def, live_head, 1 pdp_prep, 5 cdp_prep, 5 rra_ptr, 30 rows
+	size := 128 + 120*6 + 16 + 112 + 80*5 + 8*5 + 8*30
+	if len(data) != size {
+		t.Fatalf("size of file %d, expected %d", len(data), size)
+	}
+	if string(data[0:4]) != "RRD\x00" || string(data[4:9]) != "0003\x00" {
+		t.Errorf("bad cookie or version: %q", data[0:9])
+	}
+	if math.Float64frombits(binary.LittleEndian.Uint64(data[16:])) != 8.642135e130 {
+		t.Errorf("bad float cookie")
+	}
+	for _, field := range []struct {
+		offset   int
+		expected uint64
+	}{
+		{24, 1},   // ds_cnt
+		{32, 5},   // rra_cnt
+		{40, 300}, // pdp_step
+		{128 + 40, 600},
+		{128 + 120*6, rrdTestStart}, // last_up
+	} {
+		if v := binary.LittleEndian.Uint64(data[field.offset:]); v != field.expected {
+			t.Errorf("field at %d: %d, expected %d", field.offset, v, field.expected)
+		}
+	}
+	if name := rrdString(data[128 : 128+20]); name != "val" {
+		t.Errorf("ds name %q", name)
+	}
+	if typ := rrdString(data[128+20 : 128+40]); typ != "GAUGE" {
+		t.Errorf("ds type %q", typ)
+	}
+
+	f, _ := os.Open(dbfile)
+	defer f.Close()
+	hd, err := rrdReadHeader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hd.pdpPrep[0].lastDS != "U" {
+		t.Errorf("last_ds %q, expected U", hd.pdpPrep[0].lastDS)
+	}
+	for r, rra := range rrdTestArchives {
+		if hd.rraPtr[r] != uint64(rra.RowCnt-1) {
+			t.Errorf("rra_ptr %d: %d", r, hd.rraPtr[r])
+		}
+		if hd.rra[r].name != rra.CF || hd.rra[r].pdps != uint64(rra.PDPCnt) || hd.rra[r].par.get(rrdRRAXff) != 0.5 {
+			t.Errorf("rra %d: %+v", r, hd.rra[r])
+		}
+	}
+	for _, row := range rrdTestRows(t, dbfile, 0) {
+		if !math.IsNaN(row) {
+			t.Fatalf("new file has known rows")
+		}
+	}
+}
+
+func TestRRDGaugeConsolidation(t *testing.T) {
+	dbfile := rrdTestFile(t, "GAUGE", []rrdTestUpdate{
+		{300, "10"}, {600, "20"}, {900, "30"},
+		// partial steps: 150 sec of 10 and 150 sec of 20 give 15
+		{1050, "10"}, {1350, "20"}, {1500, "40"}, {1800, "50"},
+	})
+
+	rrdTestLast(t, dbfile, 0, 10, 20, 30, 15, 30, 50)
+	rrdTestLast(t, dbfile, 1, 20, 95.0/3)
+	rrdTestLast(t, dbfile, 2, 30, 50)
+	rrdTestLast(t, dbfile, 3, 10, 15)
+	rrdTestLast(t, dbfile, 4, 30, 50)
+}
+
+func TestRRDUnknown(t *testing.T) {
+	nan := math.NaN()
+	dbfile := rrdTestFile(t, "GAUGE", []rrdTestUpdate{
+		// one unknown PDP of 3 is below xff 0.5
+		{300, "U"}, {600, "20"}, {900, "30"},
+		// two unknown PDPs of 3 make CDP unknown
+		{1200, "U"}, {1500, "U"}, {1800, "40"},
+		// more than half of step is unknown
+		{2000, "U"}, {2100, "50"},
+		// gap longer than heartbeat
+		{2400, "60"}, {3300, "70"},
+		// value below min
+		{3600, "-5"},
+	})
+
+	rrdTestLast(t, dbfile, 0, 30, nan, nan, 40, nan, 60, nan, nan, nan, nan)
+	rrdTestLast(t, dbfile, 1, 25, nan, nan, nan)
+	rrdTestLast(t, dbfile, 4, 30, nan, nan, nan)
+}
+
+func TestRRDCounterWrap(t *testing.T) {
+	dbfile := rrdTestFile(t, "COUNTER", []rrdTestUpdate{
+		{300, "4294966000"}, {600, "4294967000"},
+		// 32 bit counter wrapped: 296 + 1000
+		{900, "1000"},
+		{1200, "4000"},
+	})
+
+	rrdTestLast(t, dbfile, 0, math.NaN(), 1000.0/300, 1296.0/300, 3000.0/300)
+
+	if err := RRDUpdateFile(dbfile, time.Unix(rrdTestStart+1500, 0), "-1"); err == nil {
+		t.Errorf("negative value of COUNTER is accepted")
+	}
+	if err := RRDUpdateFile(dbfile, time.Unix(rrdTestStart+1200, 0), "5000"); err == nil {
+		t.Errorf("update with time of last update is accepted")
+	}
+}
+
+func TestRRDRingBuffer(t *testing.T) {
+	updates := make([]rrdTestUpdate, 0, 25)
+	for i := int64(1); i <= 25; i++ {
+		updates = append(updates, rrdTestUpdate{i * 300, strconv.FormatInt(i, 10)})
+	}
+	dbfile := rrdTestFile(t, "GAUGE", updates)
+
+	rrdTestLast(t, dbfile, 0, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25)
+	// CDP of 3 PDPs: 22,23,24 is the last complete one, 25 is in cdp_prep
+	rrdTestLast(t, dbfile, 1, 11, 14, 17, 20, 23)
+
+	// jump over whole RRA
+	if err := RRDUpdateFile(dbfile, time.Unix(rrdTestStart+25*300+600*12, 0), "7"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RRDUpdateFile(dbfile, time.Unix(rrdTestStart+25*300+600*12+300, 0), "7"); err != nil {
+		t.Fatal(err)
+	}
+	rrdTestLast(t, dbfile, 0, 7)
+}
+
+//
+// TestRRDCompareRRDTool - files of rrd.go and rrdtool built by the same updates give the same
+// info and fetch output, skipped without rrdtool
+//
+func TestRRDCompareRRDTool(t *testing.T) {
+	rrdtool, err := exec.LookPath("rrdtool")
+	if err != nil {
+		t.Skip("rrdtool is not found in PATH")
+	}
+
+	updates := []rrdTestUpdate{
+		{300, "10"}, {450, "U"}, {600, "20"}, {1050, "30"}, {1350, "U"}, {1800, "40"}, {2100, "50"}, {3000, "60"},
+	}
+	for _, typ := range []string{"GAUGE", "COUNTER"} {
+		own := rrdTestFile(t, typ, updates)
+		ref := filepath.Join(t.TempDir(), "ref.rrd")
+
+		args := []string{"create", ref, "--start", strconv.Itoa(rrdTestStart), "--step", "300",
+			"DS:val:" + typ + ":600:0:U"}
+		for _, rra := range rrdTestArchives {
+			args = append(args, "RRA:"+rra.CF+":0.5:"+strconv.Itoa(int(rra.PDPCnt))+":"+strconv.Itoa(int(rra.RowCnt)))
+		}
+		if out, err := exec.Command(rrdtool, args...).CombinedOutput(); err != nil {
+			t.Fatalf("rrdtool create: %s %s", err, out)
+		}
+		for _, u := range updates {
+			arg := strconv.FormatInt(rrdTestStart+u.sec, 10) + ":" + u.val
+			if out, err := exec.Command(rrdtool, "update", ref, arg).CombinedOutput(); err != nil {
+				t.Fatalf("rrdtool update: %s %s", err, out)
+			}
+		}
+
+		for _, cmd := range [][]string{
+			{"info"},
+			{"fetch", "AVERAGE", "-r", "300", "-s", strconv.Itoa(rrdTestStart), "-e", strconv.Itoa(rrdTestStart + 3000)},
+			{"fetch", "MAX", "-r", "900", "-s", strconv.Itoa(rrdTestStart), "-e", strconv.Itoa(rrdTestStart + 3000)},
+		} {
+			run := func(file string) string {
+				out, err := exec.Command(rrdtool, append([]string{cmd[0], file}, cmd[1:]...)...).CombinedOutput()
+				if err != nil {
+					t.Fatalf("rrdtool %s: %s %s", cmd[0], err, out)
+				}
+				return strings.ReplaceAll(string(out), file, "FILE")
+			}
+			if a, b := run(own), run(ref); !bytes.Equal([]byte(a), []byte(b)) {
+				t.Errorf("%s: rrdtool %s differs\nrrd.go:\n%s\nrrdtool:\n%s", typ, cmd[0], a, b)
+			}
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	h "github.com/a4lex/go-helpers"
+)
+
+//
+// Series struct for store identity of fetched value
+//
+type Series struct {
+	Path        string // template path: shared/name
+	ObjectID    string // device or iface id
+	File        string // file name for file based sinks, default - ObjectID
+	DeviceID    string
+	DeviceType  string
+	IfaceID     string // empty for values of device
+	CounterType string
+	Min         int
+	Max         int
+	Step        uint
+}
+
+//
+// MetricSink interface for store fetched values, nil value is unknown (device has no value)
+//
+type MetricSink interface {
+	Store(s *Series, t time.Time, val *big.Float) error
+	Flush() error
+	Close() error
+}
+
+//
+// SinkConfig struct for store sink configs from config.yml
+//
+type SinkConfig struct {
+	Type    string `yaml:"type"`
+	Dir     string `yaml:"dir"`     // rrd: dir for RRD files
+	Output  string `yaml:"output"`  // influx, graphite: file:///path, udp://host:port, tcp://host:port, http(s)://url
+	Prefix  string `yaml:"prefix"`  // influx: measurement, graphite: metric prefix
+	Include string `yaml:"include"` // regexp, store only series with matched template path
+	Exclude string `yaml:"exclude"` // regexp, skip series with matched template path
+}
+
+//
+// MetricSinks list of all enabled sinks, value is stored in each of them
+//
+type MetricSinks []MetricSink
+
+//
+// filterSink pass to sink only series with allowed template path
+//
+type filterSink struct {
+	MetricSink
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+}
+
+var sinkFactories = map[string]func(SinkConfig) (MetricSink, error){
+	"rrd":      NewRRDSink,
+	"influx":   NewInfluxSink,
+	"graphite": NewGraphiteSink,
+}
+
+//
+// InitSinks - create all sinks from config, RRD sink is used if config is empty
+//
+func InitSinks(configs []SinkConfig) (MetricSinks, error) {
+	if len(configs) == 0 {
+		configs = []SinkConfig{{Type: "rrd"}}
+	}
+
+	ms := make(MetricSinks, 0, len(configs))
+	for _, c := range configs {
+		factory, ok := sinkFactories[c.Type]
+		if !ok {
+			ms.Close()
+			return nil, fmt.Errorf("unknown sink type: %s", c.Type)
+		}
+
+		sink, err := factory(c)
+		if err != nil {
+			ms.Close()
+			return nil, fmt.Errorf("can not init sink %s: %s", c.Type, err)
+		}
+
+		if c.Include != "" || c.Exclude != "" {
+			f := &filterSink{MetricSink: sink}
+			if c.Include != "" {
+				f.include, err = regexp.Compile(c.Include)
+			}
+			if err == nil && c.Exclude != "" {
+				f.exclude, err = regexp.Compile(c.Exclude)
+			}
+			if err != nil {
+				sink.Close()
+				ms.Close()
+				return nil, fmt.Errorf("bad path filter of sink %s: %s", c.Type, err)
+			}
+			sink = f
+		}
+		ms = append(ms, sink)
+		l.Printf(h.INFO, "Init sink: %s", c.Type)
+	}
+
+	return ms, nil
+}
+
+//
+// Store - store value in all sinks, return last error
+//
+func (ms MetricSinks) Store(s *Series, t time.Time, val *big.Float) (err error) {
+	for _, sink := range ms {
+		if e := sink.Store(s, t, val); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+//
+// Flush - write buffered values of all sinks
+//
+func (ms MetricSinks) Flush() (err error) {
+	for _, sink := range ms {
+		if e := sink.Flush(); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+//
+// Close - flush and close all sinks
+//
+func (ms MetricSinks) Close() (err error) {
+	for _, sink := range ms {
+		if e := sink.Close(); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+//
+// Store - store value if template path is allowed by filters
+//
+func (f *filterSink) Store(s *Series, t time.Time, val *big.Float) error {
+	if (f.include != nil && !f.include.MatchString(s.Path)) || (f.exclude != nil && f.exclude.MatchString(s.Path)) {
+		return nil
+	}
+	return f.MetricSink.Store(s, t, val)
+}
+
+//
+// RRDSink store values into RRD files: <dir>/<path>/<object id>
+//
+type RRDSink struct {
+	dir  string
+	mu   sync.Mutex
+	dirs map[string]bool
+}
+
+//
+// NewRRDSink - return new RRD sink, default dir is value of -dir-rrd flag
+//
+func NewRRDSink(c SinkConfig) (MetricSink, error) {
+	if c.Dir == "" {
+		c.Dir = *dirRRD
+	}
+	return &RRDSink{dir: c.Dir, dirs: make(map[string]bool)}, nil
+}
+
+//
+// Store - update RRD file of series or create it
+//
+func (r *RRDSink) Store(s *Series, t time.Time, val *big.Float) error {
+	dir := fmt.Sprintf("%s/%s", r.dir, s.Path)
+	fileRRD := fmt.Sprintf("%s/%010s", dir, s.ObjectID)
+	if s.File != "" {
+		fileRRD = fmt.Sprintf("%s/%s", dir, s.File)
+	}
+	value := rrdValue(s.CounterType, val)
+
+	if err := RRDUpdate(fileRRD, t, value); err != nil {
+		if _, errStat := os.Stat(fileRRD); !os.IsNotExist(errStat) {
+			return fmt.Errorf("can not update rrddb: %s - %s", fileRRD, err)
+		}
+		if err := r.mkdir(dir); err != nil {
+			return err
+		}
+		if err := RRDCreate(fileRRD, t.Add(-10*time.Second), s.CounterType, s.Min, s.Max, s.Step); err != nil {
+			return fmt.Errorf("can not create rrddb: %s - %s", fileRRD, err)
+		}
+		return RRDUpdate(fileRRD, t, value)
+	}
+
+	return nil
+}
+
+//
+// Flush - nothing to flush, every update is written immediately
+//
+func (r *RRDSink) Flush() error {
+	return nil
+}
+
+//
+// rrdValue - return value for update of RRD file, "U" - unknown. Counters are passed as integers
+// (rrdtool does not accept fractions for them), gauges without rounding
+//
+func rrdValue(counterType string, val *big.Float) string {
+	switch {
+	case val == nil:
+		return "U"
+	case counterType == "COUNTER" || counterType == "DERIVE":
+		return val.Text('f', 0)
+	}
+	f, _ := val.Float64()
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+//
+// Close - nothing to close
+//
+func (r *RRDSink) Close() error {
+	return nil
+}
+
+func (r *RRDSink) mkdir(dir string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.dirs[dir] {
+		return nil
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+		l.Printf(h.INFO, "Create dir for RRD files: %s", dir)
+	}
+	r.dirs[dir] = true
+	return nil
+}